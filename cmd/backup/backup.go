@@ -1,159 +1,606 @@
 package backup
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/history"
+	"zxcvmk/pkg/output"
+	"zxcvmk/pkg/progress"
 	"zxcvmk/pkg/providers"
 )
 
 type BackupArguments struct {
-	SnapshotID string
-	Paths      []string
-	Output     string
+	SnapshotID      string
+	Paths           []string
+	Output          output.Options
+	Filter          SnapshotFilter
+	GroupBy         string
+	Stats           bool
+	ExpectEvery     time.Duration
+	Sizes           bool
+	Repositories    []string
+	From            string
+	To              string
+	RetryLock       time.Duration
+	UnlockOlderThan time.Duration
+	DryRun          bool
+	ReadData        string
+	Retention       *config.Retention
+	// RemoteUser is the API user a restore is run for, recorded in the
+	// history.
+	RemoteUser string
+	// InPlace restores directly over the live files instead of through a
+	// staging directory, Overwrite and Delete tune it.
+	InPlace   bool
+	Overwrite string
+	Delete    bool
+	// RestoreOptions are added to the configured ones, MapUIDs and MapGIDs
+	// hold FROM:TO pairs added to their ID maps.
+	RestoreOptions config.RestoreOptions
+	MapUIDs        []string
+	MapGIDs        []string
+	// Parallel is how many targets are restored at the same time.
+	Parallel int
 }
 
-func runPostRestoreHook(cfg *config.Config, paths []string) {
-	for _, path := range paths {
-		for _, cfgPath := range cfg.BackupTargets {
-			if path == cfgPath.Location && cfgPath.PostRestoreHook != nil {
-				cmd := exec.Command(cfgPath.PostRestoreHook[0], cfgPath.PostRestoreHook[1:]...)
-				result, err := cmd.CombinedOutput()
-				if err != nil {
-					slog.Error("error executing post-restore-hook for %s: %s", path, result)
-				}
+func runPostRestoreHook(ctx context.Context, cfg *config.Config, paths []string, entry *history.Entry) error {
+	var errs []error
+	for _, target := range restoreTargets(cfg, paths) {
+		if target.PostRestoreHook != nil {
+			if err := runHook(ctx, "post-restore-hook", target.Location, target.PostRestoreHook, entry); err != nil {
+				// keep going, every target's services should be brought back
+				errs = append(errs, err)
 			}
 		}
 	}
+	return errors.Join(errs...)
 }
 
-func runPreRestoreHook(cfg *config.Config, paths []string) {
-	for _, path := range paths {
-		for _, cfgPath := range cfg.BackupTargets {
-			if path == cfgPath.Location && cfgPath.PreRestoreHook != nil {
-				cmd := exec.Command(cfgPath.PreRestoreHook[0], cfgPath.PreRestoreHook[1:]...)
-				result, err := cmd.CombinedOutput()
-				if err != nil {
-					slog.Error("pre-restore-hook failed with {err}: {res}", "err", err, "res", result)
-				}
+func runPreRestoreHook(ctx context.Context, cfg *config.Config, paths []string, entry *history.Entry) error {
+	for _, target := range restoreTargets(cfg, paths) {
+		if target.PreRestoreHook != nil {
+			if err := runHook(ctx, "pre-restore-hook", target.Location, target.PreRestoreHook, entry); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
 }
 
-func rsyncPaths(from string, paths []string) error {
+// restoreTargets returns the targets containing the restored paths, each
+// once, so that restoring a file or directory inside a target runs its hooks.
+func restoreTargets(cfg *config.Config, paths []string) []config.BackupTarget {
+	var targets []config.BackupTarget
 	for _, path := range paths {
-		full_path := filepath.Join(from, path)
-		if full_path[len(full_path)-1] != filepath.Separator {
-			full_path = full_path + string(filepath.Separator)
-		}
-		rsyncArgs := []string{"-a", "-v", full_path, path}
-		cmd := exec.Command("rsync", rsyncArgs...)
-		cmd.Dir = from
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			slog.Error("error rsync paths", "from", from, "path", path, "output", output)
-			return err
+		target, ok := cfg.TargetOf(path)
+		if ok && !slices.ContainsFunc(targets, func(t config.BackupTarget) bool { return t.Location == target.Location }) {
+			targets = append(targets, target)
 		}
 	}
+	return targets
+}
+
+// runHook runs a hook command for path and records it in the history entry.
+func runHook(ctx context.Context, name, path string, command []string, entry *history.Entry) error {
+	started := time.Now()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	result, err := cmd.CombinedOutput()
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	entry.AddHook(name, path, command, started, exitCode, err)
+	if err != nil {
+		slog.Error(name+" failed", "path", path, "err", err, "res", string(result))
+		return fmt.Errorf("%w: %s for %s: %s", providers.ErrHookFailed, name, path, err)
+	}
 	return nil
 }
 
-func setupBackupProvider(cfg *config.Config) providers.BackupProvider {
-	var backupProviderImpl providers.BackupProvider
-	var activeProvider config.BackupProvider
-	for _, provider := range cfg.BackupProviders {
-		if provider.Name == cfg.BackupProvider {
-			activeProvider = provider
-			switch provider.Name {
-			case "restic":
-				backupProviderImpl = providers.NewResticProvider(activeProvider.BackupRepositoryPasswordLocation, activeProvider.BackupRepository)
-			}
+// rsyncPaths copies the paths from the restore in from into place. A failing
+// path does not stop the others, the services of the target are down for
+// the restore anyway.
+func rsyncPaths(ctx context.Context, from string, paths []string, opts config.RestoreOptions, onProgress progress.Func) error {
+	var errs []error
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
 			break
 		}
+		if err := rsyncPath(ctx, from, path, opts, onProgress); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
 	}
-	return backupProviderImpl
+	return errors.Join(errs...)
 }
 
-func Restore(cfg *config.Config, backupArguments BackupArguments) {
-	backupProviderImpl := setupBackupProvider(cfg)
-	snapshots, err := backupProviderImpl.ListSnapshots(backupArguments.Paths)
+func rsyncPath(ctx context.Context, from string, path string, opts config.RestoreOptions, onProgress progress.Func) error {
+	full_path := filepath.Join(from, path)
+	// a single file is copied onto path, a directory's contents into it
+	if info, err := os.Stat(full_path); err == nil && info.IsDir() && full_path[len(full_path)-1] != filepath.Separator {
+		full_path = full_path + string(filepath.Separator)
+	}
+	rsyncArgs := append(rsyncFlags(opts), "--info=progress2", "--no-inc-recursive", full_path, path)
+	cmd := exec.CommandContext(ctx, "rsync", rsyncArgs...)
+	cmd.Dir = from
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		fmt.Printf("Error listing snapshots: %s", err)
+		return err
 	}
-	if snapshot, found := findSnapshotByID(snapshots, backupArguments.SnapshotID); found {
-		target, err := createSnapshotMountTarget()
-		defer func() {
-			_ = deleteSnapshotMountTarget(target)
-		}()
-		if err != nil {
-			slog.Error("Snapshot target directory could not be created", "error", err)
-			return
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		if event, ok := parseRsyncProgress(scanner.Text()); ok {
+			event.Path = path
+			onProgress.Report(event)
 		}
-		err = backupProviderImpl.RestoreSnapshot(snapshot.ID, target, backupArguments.Paths)
-		if err != nil {
-			slog.Error("restore failed", "error", err.Error())
-			return
+	}
+	if err = scanner.Err(); err != nil {
+		// keep rsync from blocking on a full pipe, only the progress is lost
+		slog.Warn("cannot read rsync progress", "path", path, "error", err)
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+	if err = cmd.Wait(); err != nil {
+		slog.Error("error rsync paths", "from", from, "path", path, "output", stderr.String())
+		return err
+	}
+	return nil
+}
+
+// rsyncProgressRe matches the overall progress lines printed by
+// `rsync --info=progress2`, e.g.
+// "  1,238,099  45%  146.38MB/s  0:00:03 (xfr#5, to-chk=10/16)".
+var rsyncProgressRe = regexp.MustCompile(`^\s*([\d,]+)\s+(\d+)%\s+\S+\s+(\d+):(\d{2}):(\d{2})(?:\s+\(xfr#\d+, (?:ir|to)-chk=(\d+)/(\d+)\))?`)
+
+func parseRsyncProgress(line string) (progress.Event, bool) {
+	m := rsyncProgressRe.FindStringSubmatch(line)
+	if m == nil {
+		return progress.Event{}, false
+	}
+	bytesDone, _ := strconv.ParseUint(strings.ReplaceAll(m[1], ",", ""), 10, 64)
+	percent, _ := strconv.ParseFloat(m[2], 64)
+	hours, _ := strconv.Atoi(m[3])
+	minutes, _ := strconv.Atoi(m[4])
+	seconds, _ := strconv.Atoi(m[5])
+	event := progress.Event{
+		Source:    "rsync",
+		Percent:   percent,
+		BytesDone: bytesDone,
+	}
+	if percent > 0 {
+		event.BytesTotal = uint64(float64(bytesDone) * 100 / percent)
+	}
+	// while a file is in flight the time column is the remaining time, once
+	// it is done rsync prints the elapsed time instead
+	if m[6] == "" {
+		event.ETA = time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second
+	}
+	if m[7] != "" {
+		remaining, _ := strconv.ParseUint(m[6], 10, 64)
+		total, _ := strconv.ParseUint(m[7], 10, 64)
+		event.FilesTotal = total
+		event.FilesDone = total - remaining
+	}
+	return event, true
+}
+
+// scanProgressLines splits on both \r and \n, as progress output redraws the
+// same line with carriage returns.
+func scanProgressLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// RestoreReport describes the restore of the paths of one target.
+type RestoreReport struct {
+	Snapshot   string   `json:"snapshot"`
+	Repository string   `json:"repository"`
+	Paths      []string `json:"paths"`
+	// Status is "restored" or "failed", Error tells why.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Mode is how the files were put into place: "staging" or "in-place".
+	Mode string `json:"mode"`
+	// Moved lists the paths on the staging filesystem, which were moved
+	// into place instead of copied.
+	Moved    []string      `json:"moved,omitempty" output:"wide"`
+	Duration time.Duration `json:"duration"`
+	// OwnershipMismatches counts the files whose owner differs from the one
+	// in the snapshot after mapping, Ownership lists the first of them.
+	OwnershipMismatches int                 `json:"ownershipMismatches"`
+	Ownership           []OwnershipMismatch `json:"ownership,omitempty" output:"-"`
+	// Verify is how the restored files were compared with the snapshot,
+	// empty if they were not. VerifyMismatches counts the files that
+	// differ, Mismatches lists the first of them.
+	Verify           string         `json:"verify,omitempty"`
+	VerifiedFiles    int            `json:"verifiedFiles,omitempty"`
+	VerifyMismatches int            `json:"verifyMismatches,omitempty"`
+	Mismatches       []FileMismatch `json:"mismatches,omitempty" output:"-"`
+}
+
+// Restore restores the paths from a snapshot and prints a report per
+// target, also when some of them failed.
+func Restore(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) error {
+	reports, err := RestorePaths(ctx, cfg, backupArguments)
+	if len(reports) == 0 {
+		return err
+	}
+	if printErr := output.Print(reports, backupArguments.Output); err == nil {
+		err = printErr
+	}
+	return err
+}
+
+// RestorePaths restores the paths from the snapshot
+// backupArguments.SnapshotID. The paths are grouped by the target containing
+// them and the groups are restored concurrently, up to
+// backupArguments.Parallel at a time, each between the restore hooks of its
+// target and through its own staging directory. A failing group does not
+// stop the others. It returns a report per group, in the order of the paths.
+func RestorePaths(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) (reports []*RestoreReport, err error) {
+	defer func() {
+		// the groups record their own runs
+		if reports == nil && err != nil {
+			entry := history.NewEntry("restore", backupArguments.Paths...)
+			entry.RemoteUser = backupArguments.RemoteUser
+			recordRun(ctx, cfg, entry, err)
 		}
+	}()
+	if len(backupArguments.Paths) == 0 {
+		return nil, errors.New("no paths to restore, set --filter-path")
+	}
+	if backupArguments.Delete && !backupArguments.InPlace {
+		return nil, errors.New("--delete needs --in-place")
+	}
+	if backupArguments.InPlace && !slices.Contains(providers.OverwriteModes, backupArguments.Overwrite) {
+		return nil, fmt.Errorf("invalid --overwrite %q, use one of %s", backupArguments.Overwrite, strings.Join(providers.OverwriteModes, ", "))
+	}
+	if _, err := restoreOptions(cfg, backupArguments); err != nil {
+		return nil, err
+	}
+	repos, err := setupRepositories(ctx, cfg, backupArguments)
+	if err != nil {
+		return nil, err
+	}
+	repo, snapshot, err := findSnapshot(ctx, repos, backupArguments)
+	if err != nil {
+		return nil, err
+	}
+	groups := restoreGroups(cfg, backupArguments.Paths)
+	slog.Info("restoring snapshot", "snapshot", snapshot.ShortID, "repository", repo.Name, "inPlace", backupArguments.InPlace, "groups", len(groups))
 
-		runPreRestoreHook(cfg, backupArguments.Paths)
-		defer func() {
-			runPostRestoreHook(cfg, backupArguments.Paths)
+	reporter := progress.NewReporter(os.Stdout)
+	// groups sharing a staging filesystem need room for all of them
+	ledger := newSpaceLedger()
+	reports = make([]*RestoreReport, len(groups))
+	errs := make([]error, len(groups))
+	slots := make(chan struct{}, max(backupArguments.Parallel, 1))
+	var wg sync.WaitGroup
+	for i, paths := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			groupArguments := backupArguments
+			groupArguments.Paths = paths
+			reports[i], errs[i] = restoreGroup(ctx, cfg, groupArguments, repo, snapshot, reporter, ledger)
 		}()
-		err = rsyncPaths(target, backupArguments.Paths)
-		if err != nil {
-			slog.Error("failed to rsync contents", "error", err)
+	}
+	wg.Wait()
+	// the groups share the bar line, it is finished once they all are
+	reporter.Done()
+
+	if len(groups) == 1 {
+		return reports, errs[0]
+	}
+	for i, groupErr := range errs {
+		if groupErr != nil {
+			errs[i] = fmt.Errorf("%s: %w", strings.Join(groups[i], ", "), groupErr)
 		}
-	} else {
-		slog.Error("Snapshot not found")
 	}
+	return reports, errors.Join(errs...)
+}
+
+// restoreGroups groups the paths by the target containing them, paths
+// outside of every target are restored on their own.
+func restoreGroups(cfg *config.Config, paths []string) [][]string {
+	var groups [][]string
+	keys := map[string]int{}
+	for _, path := range paths {
+		key := path
+		if target, ok := cfg.TargetOf(path); ok {
+			key = target.Location
+		}
+		if i, ok := keys[key]; ok {
+			groups[i] = append(groups[i], path)
+			continue
+		}
+		keys[key] = len(groups)
+		groups = append(groups, []string{path})
+	}
+	return groups
 }
 
-func List(cfg *config.Config, backupArguments BackupArguments) {
-	backupProviderImpl := setupBackupProvider(cfg)
-	snapshots, err := backupProviderImpl.ListSnapshots(backupArguments.Paths)
+// restoreGroup restores the paths of one target and records the run.
+func restoreGroup(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, repo repository, snapshot *providers.Snapshot, reporter *progress.Reporter, ledger *spaceLedger) (_ *RestoreReport, err error) {
+	entry := history.NewEntry("restore", backupArguments.Paths...)
+	entry.RemoteUser = backupArguments.RemoteUser
+	entry.Repository, entry.Snapshot = repo.Name, snapshot.ID
+	report := &RestoreReport{
+		Snapshot:   snapshot.ID,
+		Repository: repo.Name,
+		Paths:      backupArguments.Paths,
+		Status:     "restored",
+		Mode:       "staging",
+	}
+	if backupArguments.InPlace {
+		report.Mode = "in-place"
+	}
+	started := time.Now()
+	defer func() {
+		report.Duration = time.Since(started)
+		if err != nil {
+			report.Status, report.Error = "failed", err.Error()
+			slog.Error("restore failed", "paths", backupArguments.Paths, "error", err)
+		}
+		recordRun(ctx, cfg, entry, err)
+	}()
+	// waiting for a slot may have outlasted ctx, the hooks must not run
+	if ctx.Err() != nil {
+		return report, fmt.Errorf("%w: restore not started", providers.ErrInterrupted)
+	}
+	opts, err := restoreOptions(cfg, backupArguments)
 	if err != nil {
-		fmt.Printf("Error listing snapshots: %s", err)
-		return
+		return report, err
 	}
-	var output string
-	if backupArguments.Output != "" {
-		output = backupArguments.Output
+	onProgress := groupProgress(reporter, backupArguments.Paths)
+	if backupArguments.InPlace {
+		err = restoreInPlace(ctx, cfg, backupArguments, opts, repo, snapshot, entry, report, onProgress)
 	} else {
-		output = "json"
+		err = restoreStaged(ctx, cfg, backupArguments, opts, repo, snapshot, entry, report, ledger, onProgress)
 	}
-	out, _ := config.Output(snapshots, output)
-	fmt.Println(out)
-
+	if err != nil {
+		return report, err
+	}
+	if walker, ok := repo.Provider.(providers.Walker); ok {
+		var checkErr error
+		report.Ownership, report.OwnershipMismatches, checkErr = checkOwnership(ctx, walker, snapshot, backupArguments.Paths, opts)
+		if checkErr != nil {
+			slog.Warn("cannot check the ownership of the restored files", "error", checkErr)
+		}
+		if report.OwnershipMismatches > 0 {
+			slog.Warn("ownership of restored files could not be preserved", "paths", backupArguments.Paths, "files", report.OwnershipMismatches)
+		}
+	}
+	return report, nil
 }
 
-func findSnapshotByID(snapshots []*providers.Snapshot, id string) (*providers.Snapshot, bool) {
-	for i := range snapshots {
-		if snapshots[i].ID == id {
-			return snapshots[i], true
+// groupProgress labels the progress of a group's restore with its paths,
+// restic reports the snapshot instead.
+func groupProgress(reporter *progress.Reporter, paths []string) progress.Func {
+	label := strings.Join(paths, ",")
+	return func(e progress.Event) {
+		if !slices.Contains(paths, e.Path) {
+			e.Path = label
 		}
+		reporter.Report(e)
 	}
-	return nil, false
 }
 
-func createSnapshotMountTarget() (string, error) {
-	tmpdir := os.TempDir()
-	target_tmpdir, err := os.MkdirTemp(tmpdir, "snapshot-")
+// restoreStaged restores the snapshot into the staging directory and copies
+// or moves the paths into place.
+func restoreStaged(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, opts config.RestoreOptions, repo repository, snapshot *providers.Snapshot, entry *history.Entry, report *RestoreReport, ledger *spaceLedger, onProgress progress.Func) (err error) {
+	plan, release, err := planStaging(cfg.StagingDirectory(backupArguments.Paths[0]), backupArguments.Paths, restoreSize(ctx, repo, snapshot, backupArguments.Paths), ledger)
+	if err != nil {
+		return err
+	}
+	defer release()
+	report.Moved = plan.Move
+	target, err := createSnapshotMountTarget(plan.Dir)
+	if err != nil {
+		return fmt.Errorf("snapshot target directory could not be created: %w", err)
+	}
+	defer func() {
+		_ = deleteSnapshotMountTarget(target)
+	}()
+	err = repo.Provider.RestoreSnapshot(ctx, snapshot.ID, target, backupArguments.Paths, onProgress)
+	if err != nil {
+		return fmt.Errorf("restore failed: %w", describeLocks(ctx, repo.Provider, err))
+	}
+	for _, path := range backupArguments.Paths {
+		if _, statErr := os.Stat(filepath.Join(target, path)); statErr != nil {
+			return fmt.Errorf("%w: %s is not part of snapshot %s", providers.ErrTargetMissing, path, snapshot.ShortID)
+		}
+		if err = remapOwnership(ctx, filepath.Join(target, path), opts); err != nil {
+			return err
+		}
+	}
+	expected := manifest{}
+	if opts.Verify != "" {
+		for _, path := range backupArguments.Paths {
+			if err = stagedManifest(ctx, expected, target, path, opts.Verify == config.VerifyHashes); err != nil {
+				return fmt.Errorf("cannot record the restored files: %w", err)
+			}
+		}
+	}
 
+	defer func() {
+		// services have to come back up even if the restore was
+		// interrupted, so the hook must outlive ctx
+		hookErr := runPostRestoreHook(context.WithoutCancel(ctx), cfg, backupArguments.Paths, entry)
+		if err == nil {
+			err = hookErr
+		}
+	}()
+	if err = runPreRestoreHook(ctx, cfg, backupArguments.Paths, entry); err != nil {
+		return err
+	}
+	if opts.Verify != "" {
+		// before the post hook restarts anything that changes the files,
+		// and also after a failed copy, the paths copied until then are
+		// checked
+		report.Verify = opts.Verify
+		defer func() {
+			if ctx.Err() != nil {
+				return
+			}
+			if verifyErr := verifyRestore(ctx, report, expected, opts, false); err == nil {
+				err = verifyErr
+			}
+		}()
+	}
+	var copyPaths []string
+	for _, path := range backupArguments.Paths {
+		if !slices.Contains(plan.Move, path) {
+			copyPaths = append(copyPaths, path)
+		}
+	}
+	for _, path := range plan.Move {
+		slog.Info("moving restored files into place", "path", path)
+		if err = moveTree(ctx, filepath.Join(target, path), path); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("%w: failed to move contents: %w", providers.ErrInterrupted, err)
+			}
+			// bind mounts share the device of their filesystem but cannot
+			// be renamed across, what is left in staging is copied
+			if errors.Is(err, syscall.EXDEV) {
+				slog.Warn("cannot move across mount points, copying instead", "path", path)
+				report.Moved = slices.DeleteFunc(slices.Clone(report.Moved), func(p string) bool { return p == path })
+				copyPaths = append(copyPaths, path)
+				continue
+			}
+			return fmt.Errorf("failed to move contents of %s: %w", path, err)
+		}
+	}
+	err = rsyncPaths(ctx, target, copyPaths, opts, onProgress)
 	if err != nil {
-		return "", err
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: failed to rsync contents: %w", providers.ErrInterrupted, err)
+		}
+		return fmt.Errorf("failed to rsync contents: %w", err)
 	}
-	return target_tmpdir, nil
+	return nil
 }
 
-func deleteSnapshotMountTarget(target string) error {
-	err := os.RemoveAll(target)
-	if err != nil {
-		slog.Error("error when removeall %s: %s", target, err)
+// restoreInPlace restores the paths directly over the live files, between
+// the restore hooks. An interrupted in-place restore leaves the paths half
+// restored.
+func restoreInPlace(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, opts config.RestoreOptions, repo repository, snapshot *providers.Snapshot, entry *history.Entry, report *RestoreReport, onProgress progress.Func) (err error) {
+	restorer, ok := repo.Provider.(providers.InPlaceRestorer)
+	if !ok {
+		return fmt.Errorf("%s: backup provider does not support in-place restores", repo.Name)
+	}
+	// check before the hooks stop anything, restic silently restores
+	// nothing for paths missing in the snapshot
+	if browser, ok := repo.Provider.(providers.Browser); ok {
+		for _, path := range backupArguments.Paths {
+			if _, err := statSnapshotFile(ctx, browser, snapshot, path); err != nil {
+				return err
+			}
+		}
+	} else {
+		slog.Warn("cannot check that the paths are part of the snapshot", "repository", repo.Name)
+	}
+	if err := checkInPlaceSpace(backupArguments.Paths, restoreSize(ctx, repo, snapshot, backupArguments.Paths)); err != nil {
 		return err
 	}
-	return nil
+
+	defer func() {
+		hookErr := runPostRestoreHook(context.WithoutCancel(ctx), cfg, backupArguments.Paths, entry)
+		if err == nil {
+			err = hookErr
+		}
+	}()
+	if err = runPreRestoreHook(ctx, cfg, backupArguments.Paths, entry); err != nil {
+		return err
+	}
+	err = restorer.RestoreInPlace(ctx, snapshot.ID, backupArguments.Paths, providers.InPlaceOptions{
+		Overwrite: backupArguments.Overwrite,
+		Delete:    backupArguments.Delete,
+	}, onProgress)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: in-place restore: %w", providers.ErrInterrupted, err)
+		}
+		return fmt.Errorf("restore failed: %w", describeLocks(ctx, repo.Provider, err))
+	}
+	for _, path := range backupArguments.Paths {
+		if err = remapOwnership(ctx, path, opts); err != nil {
+			return fmt.Errorf("failed to remap ownership of %s: %w", path, err)
+		}
+	}
+	if opts.Verify == "" {
+		return nil
+	}
+	walker, ok := repo.Provider.(providers.Walker)
+	if !ok {
+		slog.Warn("cannot verify the restored files, the backup provider cannot list them", "repository", repo.Name)
+		return nil
+	}
+	if opts.Verify == config.VerifyHashes {
+		slog.Warn("comparing the file list and sizes only, hashes need a staged restore")
+	}
+	report.Verify = config.VerifyFiles
+	expected := manifest{}
+	for _, path := range backupArguments.Paths {
+		if err = snapshotManifest(ctx, expected, walker, snapshot, path); err != nil {
+			return fmt.Errorf("cannot list the files of snapshot %s: %w", snapshot.ShortID, err)
+		}
+	}
+	return verifyRestore(ctx, report, expected, opts, backupArguments.Delete)
+}
+
+// findSnapshot looks up the requested snapshot in the given repositories and
+// returns the first repository holding it. The snapshots are not filtered by
+// the paths, which may lie inside the snapshot paths.
+func findSnapshot(ctx context.Context, repos []repository, backupArguments BackupArguments) (repository, *providers.Snapshot, error) {
+	for _, repo := range repos {
+		snapshots, err := repo.Provider.ListSnapshots(ctx, nil)
+		if err != nil {
+			return repository{}, nil, fmt.Errorf("error listing snapshots in %s: %w", repo.Name, describeLocks(ctx, repo.Provider, err))
+		}
+		if snapshot, found := findSnapshotByID(snapshots, backupArguments.SnapshotID); found {
+			return repo, snapshot, nil
+		}
+	}
+	return repository{}, nil, fmt.Errorf("%w: %s", providers.ErrSnapshotNotFound, backupArguments.SnapshotID)
+}
+
+func findSnapshotByID(snapshots []*providers.Snapshot, id string) (*providers.Snapshot, bool) {
+	for i := range snapshots {
+		if snapshots[i].ID == id {
+			return snapshots[i], true
+		}
+	}
+	return nil, false
 }
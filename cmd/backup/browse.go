@@ -0,0 +1,471 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/providers"
+
+	"golang.org/x/term"
+)
+
+const (
+	// previewBytes is how much of a file is read for a preview.
+	previewBytes = 64 * 1024
+	previewLines = 40
+)
+
+var (
+	errQuit = errors.New("quit")
+	errBack = errors.New("back")
+)
+
+// browser is the state of an interactive backup browse session.
+type browser struct {
+	ctx             context.Context
+	cfg             *config.Config
+	backupArguments BackupArguments
+	lines           <-chan inputLine
+	out             io.Writer
+}
+
+// inputLine is a line read from the terminal, or the error that ended the
+// input.
+type inputLine struct {
+	text string
+	err  error
+}
+
+// readLines reads r in the background, so that a prompt waiting for input
+// can still be interrupted. The channel is closed at the end of input.
+func readLines(r io.Reader) <-chan inputLine {
+	lines := make(chan inputLine)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- inputLine{text: scanner.Text()}
+		}
+		if err := scanner.Err(); err != nil {
+			lines <- inputLine{err: err}
+		}
+	}()
+	return lines
+}
+
+// Browse lets the user pick a target, a snapshot and files inside it in the
+// terminal, and preview, diff, dump or restore them.
+func Browse(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return errors.New("backup browse needs an interactive terminal")
+	}
+	b := &browser{
+		ctx:             ctx,
+		cfg:             cfg,
+		backupArguments: backupArguments,
+		lines:           readLines(os.Stdin),
+		out:             os.Stdout,
+	}
+	for {
+		target, err := b.pickTarget()
+		if err != nil {
+			return b.done(err)
+		}
+		for {
+			snapshot, err := b.pickSnapshot(target)
+			if errors.Is(err, errBack) {
+				break
+			}
+			if err != nil {
+				return b.done(err)
+			}
+			if err = b.browseFiles(target, snapshot); !errors.Is(err, errBack) {
+				return b.done(err)
+			}
+		}
+	}
+}
+
+func (b *browser) done(err error) error {
+	if errors.Is(err, errQuit) {
+		return nil
+	}
+	if err != nil && b.ctx.Err() != nil && !errors.Is(err, providers.ErrInterrupted) {
+		return fmt.Errorf("%w: %w", providers.ErrInterrupted, err)
+	}
+	return err
+}
+
+// readLine waits for the next line of input. The end of input quits,
+// interrupting the command ends the session with ErrInterrupted.
+func (b *browser) readLine() (string, error) {
+	select {
+	case <-b.ctx.Done():
+		fmt.Fprintln(b.out)
+		return "", providers.ErrInterrupted
+	case line, ok := <-b.lines:
+		if !ok {
+			fmt.Fprintln(b.out)
+			return "", errQuit
+		}
+		return strings.TrimSpace(line.text), line.err
+	}
+}
+
+// prompt reads a line. q quits, b goes back.
+func (b *browser) prompt(label string) (string, error) {
+	fmt.Fprintf(b.out, "%s> ", label)
+	line, err := b.readLine()
+	if err != nil {
+		return "", err
+	}
+	switch line {
+	case "q", "quit":
+		return "", errQuit
+	case "b", "back":
+		return "", errBack
+	}
+	return line, nil
+}
+
+// choose reads the number of one of n items.
+func (b *browser) choose(label string, n int) (int, error) {
+	for {
+		line, err := b.prompt(label)
+		if err != nil {
+			return 0, err
+		}
+		if i, err := strconv.Atoi(line); err == nil && i >= 1 && i <= n {
+			return i - 1, nil
+		}
+		fmt.Fprintf(b.out, "enter a number from 1 to %d, b to go back or q to quit\n", n)
+	}
+}
+
+func (b *browser) confirm(question string) bool {
+	fmt.Fprintf(b.out, "%s [y/N] ", question)
+	answer, err := b.readLine()
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
+
+func (b *browser) table(print func(w io.Writer)) {
+	w := tabwriter.NewWriter(b.out, 0, 0, 2, ' ', 0)
+	print(w)
+	_ = w.Flush()
+}
+
+func (b *browser) pickTarget() (string, error) {
+	targets := b.backupArguments.Paths
+	if len(targets) == 0 {
+		for _, target := range b.cfg.BackupTargets {
+			targets = append(targets, target.Location)
+		}
+	}
+	if len(targets) == 0 {
+		return "", errors.New("no backup targets configured")
+	}
+	fmt.Fprintln(b.out, "\nBackup targets:")
+	b.table(func(w io.Writer) {
+		for i, target := range targets {
+			fmt.Fprintf(w, "%3d\t%s\t%s\n", i+1, target, strings.Join(b.cfg.TargetRepositories(target), ", "))
+		}
+	})
+	for {
+		i, err := b.choose("target", len(targets))
+		if errors.Is(err, errBack) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return targets[i], nil
+	}
+}
+
+func (b *browser) pickSnapshot(target string) (*providers.Snapshot, error) {
+	args := b.backupArguments
+	args.Paths = []string{target}
+	snapshots, err := Snapshots(b.ctx, b.cfg, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		fmt.Fprintf(b.out, "no snapshots of %s\n", target)
+		return nil, errBack
+	}
+	slices.SortFunc(snapshots, func(a, b *providers.Snapshot) int {
+		return strings.Compare(b.Time, a.Time)
+	})
+	fmt.Fprintf(b.out, "\nSnapshots of %s, newest first:\n", target)
+	b.table(func(w io.Writer) {
+		for i, snapshot := range snapshots {
+			fmt.Fprintf(w, "%3d\t%s\t%s\t%s\t%s\t%s\n", i+1, snapshotTime(snapshot), snapshot.ShortID, snapshot.Hostname, snapshot.Repository, snapshot.Size)
+		}
+	})
+	i, err := b.choose("snapshot", len(snapshots))
+	if err != nil {
+		return nil, err
+	}
+	return snapshots[i], nil
+}
+
+func snapshotTime(snapshot *providers.Snapshot) string {
+	t, err := snapshot.Timestamp()
+	if err != nil {
+		return snapshot.Time
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+const filesHelp = `  N          open directory N, or preview file N
+  p N        preview file N
+  d N        diff file N against the live file
+  x N [FILE] dump file N, or a tar of directory N, to FILE
+  r [N]      restore entry N, or the current directory, running the hooks
+  ..         parent directory
+  b          back to the snapshots
+  q          quit`
+
+func (b *browser) browseFiles(target string, snapshot *providers.Snapshot) error {
+	args := b.backupArguments
+	args.SnapshotID = snapshot.ID
+	args.Paths = nil
+	if snapshot.Repository != "" {
+		args.Repositories = []string{snapshot.Repository}
+	}
+	dir, shown := target, ""
+	for {
+		files, err := ListFiles(b.ctx, b.cfg, args, dir)
+		if err != nil {
+			if shown == "" || b.ctx.Err() != nil {
+				return err
+			}
+			// stay in the directory shown before
+			fmt.Fprintf(b.out, "error: %s\n", err)
+			dir = shown
+			continue
+		}
+		shown = dir
+		slices.SortFunc(files, func(a, b *providers.File) int {
+			if a.IsDir() != b.IsDir() {
+				if a.IsDir() {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(a.Name, b.Name)
+		})
+		fmt.Fprintf(b.out, "\n%s in %s (%s), ? for help:\n", dir, snapshot.ShortID, snapshotTime(snapshot))
+		b.table(func(w io.Writer) {
+			for i, file := range files {
+				name := file.Name
+				if file.IsDir() {
+					name += "/"
+				}
+				fmt.Fprintf(w, "%3d\t%s\t%s\t%s\n", i+1, name, file.Size, file.ModTime.Local().Format("2006-01-02 15:04"))
+			}
+		})
+
+		for next := false; !next; {
+			line, err := b.prompt("file")
+			if err != nil {
+				return err
+			}
+			command, arg, _ := strings.Cut(line, " ")
+			if _, err := strconv.Atoi(command); err == nil {
+				command, arg = "open", command
+			}
+			var file *providers.File
+			if arg != "" {
+				number, rest, _ := strings.Cut(strings.TrimSpace(arg), " ")
+				i, err := strconv.Atoi(number)
+				if err != nil || i < 1 || i > len(files) {
+					fmt.Fprintf(b.out, "no entry %s\n", number)
+					continue
+				}
+				file, arg = files[i-1], strings.TrimSpace(rest)
+			}
+			switch {
+			case command == "":
+			case command == "..":
+				if dir != "/" {
+					dir, next = path.Dir(dir), true
+				}
+			case command == "open" && file != nil && file.IsDir():
+				dir, next = file.Path, true
+			case (command == "open" || command == "p") && file != nil:
+				err = b.preview(args, file)
+			case command == "d" && file != nil:
+				err = b.diff(args, snapshot, file)
+			case command == "x" && file != nil:
+				err = b.dump(args, file, arg)
+			case command == "r":
+				restorePath := dir
+				if file != nil {
+					restorePath = file.Path
+				}
+				err = b.restore(args, snapshot, restorePath)
+			default:
+				fmt.Fprintln(b.out, filesHelp)
+			}
+			if err != nil {
+				if b.ctx.Err() != nil {
+					return err
+				}
+				fmt.Fprintf(b.out, "error: %s\n", err)
+			}
+		}
+	}
+}
+
+// headWriter keeps the first limit bytes written to it and cancels the
+// dump once it has them.
+type headWriter struct {
+	buf    bytes.Buffer
+	limit  int
+	cancel context.CancelFunc
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if room := h.limit - h.buf.Len(); room > 0 {
+		h.buf.Write(p[:min(room, len(p))])
+	}
+	if h.buf.Len() >= h.limit {
+		h.cancel()
+	}
+	return len(p), nil
+}
+
+func (b *browser) preview(args BackupArguments, file *providers.File) error {
+	if file.IsDir() {
+		return fmt.Errorf("%s is a directory", file.Path)
+	}
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+	head := &headWriter{limit: previewBytes, cancel: cancel}
+	if err := Dump(ctx, b.cfg, args, file.Path, head); err != nil && ctx.Err() == nil {
+		return err
+	}
+	content := head.buf.Bytes()
+	if bytes.IndexByte(content, 0) >= 0 {
+		fmt.Fprintf(b.out, "%s is a binary file of %d bytes\n", file.Path, uint64(file.Size))
+		return nil
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if len(lines) > 1 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > previewLines {
+		lines = lines[:previewLines]
+	}
+	fmt.Fprintf(b.out, "--- %s\n%s", file.Path, strings.Join(lines, ""))
+	if !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		fmt.Fprintln(b.out)
+	}
+	if len(lines) == previewLines || len(content) == previewBytes {
+		fmt.Fprintln(b.out, "--- (truncated)")
+	}
+	return nil
+}
+
+func (b *browser) diff(args BackupArguments, snapshot *providers.Snapshot, file *providers.File) error {
+	if file.IsDir() {
+		return fmt.Errorf("%s is a directory, diff compares files", file.Path)
+	}
+	if _, err := os.Stat(file.Path); err != nil {
+		return fmt.Errorf("no live file to compare with: %w", err)
+	}
+	tmp, err := os.CreateTemp("", "zxcvmk-diff-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = Dump(b.ctx, b.cfg, args, file.Path, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(b.ctx, "diff", "-u",
+		"--label", snapshot.ShortID+":"+file.Path, "--label", file.Path,
+		tmp.Name(), file.Path)
+	cmd.Stdout = b.out
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		fmt.Fprintln(b.out, "the live file is unchanged")
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		// the files differ
+	default:
+		return fmt.Errorf("diff failed: %w", err)
+	}
+	return nil
+}
+
+func (b *browser) dump(args BackupArguments, file *providers.File, dest string) error {
+	if dest == "" {
+		dest = path.Base(file.Path)
+		if file.IsDir() {
+			dest += ".tar"
+		}
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	err = Dump(b.ctx, b.cfg, args, file.Path, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dest)
+		return err
+	}
+	fmt.Fprintf(b.out, "wrote %s\n", dest)
+	return nil
+}
+
+func (b *browser) restore(args BackupArguments, snapshot *providers.Snapshot, restorePath string) error {
+	question := fmt.Sprintf("Replace %s with its version from %s (%s)?", restorePath, snapshot.ShortID, snapshotTime(snapshot))
+	if target, ok := b.cfg.TargetOf(restorePath); ok && (target.PreRestoreHook != nil || target.PostRestoreHook != nil) {
+		question += fmt.Sprintf(" The restore hooks of %s run.", target.Location)
+	}
+	if !b.confirm(question) {
+		return nil
+	}
+	args.Paths = []string{restorePath}
+	started := time.Now()
+	reports, err := RestorePaths(b.ctx, b.cfg, args)
+	if err != nil {
+		return err
+	}
+	// a single path is a single group
+	report := reports[0]
+	fmt.Fprintf(b.out, "restored %s in %s\n", restorePath, time.Since(started).Round(time.Second))
+	if report.OwnershipMismatches > 0 {
+		fmt.Fprintf(b.out, "%d files could not get their owner from the snapshot\n", report.OwnershipMismatches)
+	}
+	if report.VerifyMismatches > 0 {
+		fmt.Fprintf(b.out, "%d files differ from the snapshot\n", report.VerifyMismatches)
+	}
+	return nil
+}
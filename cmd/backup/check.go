@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/history"
+	"zxcvmk/pkg/notify"
+	"zxcvmk/pkg/providers"
+	"zxcvmk/pkg/state"
+)
+
+// Check verifies the integrity of the selected repositories and records the
+// result for `serve metrics`.
+func Check(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) error {
+	repos, err := setupRepositories(ctx, cfg, backupArguments)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, repo := range repos {
+		checker, ok := repo.Provider.(providers.Checker)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: backup provider does not support checks", repo.Name))
+			continue
+		}
+		slog.Info("checking repository", "repository", repo.Name, "readData", backupArguments.ReadData)
+		entry := history.NewEntry("check", repo.Name)
+		entry.Repository = repo.Name
+		err := checker.Check(ctx, providers.CheckOptions{ReadData: backupArguments.ReadData})
+		recordRun(ctx, cfg, entry, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", repo.Name, describeLocks(ctx, repo.Provider, err)))
+			continue
+		}
+		slog.Info("repository is healthy", "repository", repo.Name, "duration", entry.Duration.Round(time.Second))
+	}
+	return errors.Join(errs...)
+}
+
+// recordRun finishes the history entry of an operation, stores it, records
+// it as the last run of each of its targets and notifies about it. Failing to
+// record is logged, it must not fail the operation itself.
+func recordRun(ctx context.Context, cfg *config.Config, entry *history.Entry, err error) {
+	entry.Finish(err)
+	if recordErr := history.Open(cfg.StateDirectory()).Add(entry); recordErr != nil {
+		slog.Warn("could not record history", "operation", entry.Operation, "error", recordErr)
+	}
+	store := state.Open(cfg.StateDirectory())
+	for _, target := range entry.Targets {
+		run := state.NewRun(entry.Operation, target, entry.Started, err)
+		if recordErr := store.Record(run); recordErr != nil {
+			slog.Warn("could not record run", "operation", entry.Operation, "target", target, "error", recordErr)
+		}
+		notifyEvent(ctx, cfg, notify.OperationEvent(entry.Operation, target, entry.Duration, err))
+	}
+}
@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/history"
+	"zxcvmk/pkg/output"
+	"zxcvmk/pkg/providers"
+)
+
+// DrillResult is the outcome of a test restore of one target.
+type DrillResult struct {
+	Location   string             `json:"location"`
+	Repository string             `json:"repository"`
+	Snapshot   string             `json:"snapshot,omitempty"`
+	Files      int                `json:"files"`
+	Size       providers.ByteSize `json:"size"`
+	Duration   string             `json:"duration"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// Drill test-restores the latest snapshot of the selected targets into a
+// staging directory and checks that it contains the target. Nothing is
+// restored to the live location and no hooks run.
+func Drill(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) error {
+	targets, err := selectedTargets(cfg, backupArguments.Paths)
+	if err != nil {
+		return err
+	}
+	results := []*DrillResult{}
+	var errs []error
+	for _, target := range targets {
+		repoNames := targetRepositories(cfg, backupArguments, target.Location)
+		entry := history.NewEntry("drill", target.Location)
+		entry.Repository = strings.Join(repoNames, ",")
+		var snapshots []string
+		var targetErrs []error
+		for _, name := range repoNames {
+			result := drillTarget(ctx, cfg, backupArguments, target.Location, name)
+			results = append(results, result)
+			if result.Snapshot != "" {
+				snapshots = append(snapshots, result.Snapshot)
+			}
+			if result.Error != "" {
+				targetErrs = append(targetErrs, fmt.Errorf("%s in %s: %s", target.Location, name, result.Error))
+			}
+		}
+		entry.Snapshot = strings.Join(snapshots, ",")
+		err := errors.Join(targetErrs...)
+		recordRun(ctx, cfg, entry, err)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := output.Print(results, backupArguments.Output); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+func drillTarget(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, location, repoName string) *DrillResult {
+	started := time.Now()
+	result := &DrillResult{Location: location, Repository: repoName}
+	err := func() error {
+		provider, err := setupBackupProvider(ctx, cfg, repoName, backupArguments)
+		if err != nil {
+			return err
+		}
+		repo := repository{Name: repoName, Provider: provider}
+		snapshots, err := listSnapshots(ctx, []repository{repo}, []string{location})
+		if err != nil {
+			return err
+		}
+		latest := newestSnapshot(snapshots)
+		if latest == nil {
+			return fmt.Errorf("%w: no snapshot of %s", providers.ErrSnapshotNotFound, location)
+		}
+		result.Snapshot = latest.ShortID
+		staging, err := createSnapshotMountTarget(cfg.StagingDirectory(location))
+		if err != nil {
+			return fmt.Errorf("snapshot target directory could not be created: %w", err)
+		}
+		defer func() {
+			_ = deleteSnapshotMountTarget(staging)
+		}()
+		slog.Info("test restore", "path", location, "repository", repoName, "snapshot", latest.ShortID)
+		if err := provider.RestoreSnapshot(ctx, latest.ID, staging, []string{location}, nil); err != nil {
+			return describeLocks(ctx, provider, err)
+		}
+		return filepath.WalkDir(filepath.Join(staging, location), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) && path == filepath.Join(staging, location) {
+					return fmt.Errorf("%w: %s is not part of snapshot %s", providers.ErrTargetMissing, location, latest.ShortID)
+				}
+				return err
+			}
+			if d.Type().IsRegular() {
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				result.Files++
+				result.Size += providers.ByteSize(info.Size())
+			}
+			return nil
+		})
+	}()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Duration = time.Since(started).Round(time.Second).String()
+	return result
+}
@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/providers"
+)
+
+// Snapshots returns the snapshots of the selected repositories, filtered as
+// for backup list.
+func Snapshots(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) ([]*providers.Snapshot, error) {
+	repos, err := setupRepositories(ctx, cfg, backupArguments)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := listSnapshots(ctx, repos, backupArguments.Paths)
+	if err != nil {
+		return nil, err
+	}
+	return filterSnapshots(snapshots, backupArguments.Filter, time.Now())
+}
+
+// snapshotBrowser finds backupArguments.SnapshotID in the selected
+// repositories and returns the provider to browse it with.
+func snapshotBrowser(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) (providers.Browser, *providers.Snapshot, error) {
+	repos, err := setupRepositories(ctx, cfg, backupArguments)
+	if err != nil {
+		return nil, nil, err
+	}
+	repo, snapshot, err := findSnapshot(ctx, repos, backupArguments)
+	if err != nil {
+		return nil, nil, err
+	}
+	browser, ok := repo.Provider.(providers.Browser)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: backup provider does not support browsing snapshots", repo.Name)
+	}
+	return browser, snapshot, nil
+}
+
+// StatFile returns file in the snapshot backupArguments.SnapshotID.
+func StatFile(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, file string) (*providers.File, error) {
+	browser, snapshot, err := snapshotBrowser(ctx, cfg, backupArguments)
+	if err != nil {
+		return nil, err
+	}
+	return statSnapshotFile(ctx, browser, snapshot, file)
+}
+
+func statSnapshotFile(ctx context.Context, browser providers.Browser, snapshot *providers.Snapshot, file string) (*providers.File, error) {
+	files, err := browser.ListFiles(ctx, snapshot.ID, file)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Path == path.Clean(file) {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s is not part of snapshot %s", providers.ErrTargetMissing, file, snapshot.ShortID)
+}
+
+// ListFiles returns the entries of dir in the snapshot
+// backupArguments.SnapshotID.
+func ListFiles(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, dir string) ([]*providers.File, error) {
+	browser, snapshot, err := snapshotBrowser(ctx, cfg, backupArguments)
+	if err != nil {
+		return nil, err
+	}
+	files, err := browser.ListFiles(ctx, snapshot.ID, dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*providers.File{}
+	// restic does not list the root directory itself
+	found := path.Clean(dir) == "/"
+	for _, f := range files {
+		if f.Path == path.Clean(dir) {
+			found = true
+			continue
+		}
+		entries = append(entries, f)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s is not part of snapshot %s", providers.ErrTargetMissing, dir, snapshot.ShortID)
+	}
+	return entries, nil
+}
+
+// Dump writes file, or a tar archive of a directory, from the snapshot
+// backupArguments.SnapshotID to w.
+func Dump(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, file string, w io.Writer) error {
+	browser, snapshot, err := snapshotBrowser(ctx, cfg, backupArguments)
+	if err != nil {
+		return err
+	}
+	return browser.Dump(ctx, snapshot.ID, file, w)
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/history"
+	"zxcvmk/pkg/output"
+)
+
+type HistoryArguments struct {
+	Operation string
+	Target    string
+	User      string
+	Since     string
+	Until     string
+	Failed    bool
+	Limit     int
+	Output    output.Options
+}
+
+// History prints the recorded operations, newest first, or the entry with
+// the given ID including its hooks.
+func History(ctx context.Context, cfg *config.Config, historyArguments HistoryArguments, args []string) error {
+	now := time.Now()
+	since, err := parseTimeSpec(historyArguments.Since, now)
+	if err != nil {
+		return fmt.Errorf("invalid --since: %w", err)
+	}
+	until, err := parseTimeSpec(historyArguments.Until, now)
+	if err != nil {
+		return fmt.Errorf("invalid --until: %w", err)
+	}
+	query := history.Query{
+		Operation: historyArguments.Operation,
+		Target:    historyArguments.Target,
+		User:      historyArguments.User,
+		Since:     since,
+		Until:     until,
+		Failed:    historyArguments.Failed,
+		Limit:     historyArguments.Limit,
+	}
+	if len(args) > 0 {
+		if query.ID, err = strconv.ParseUint(args[0], 10, 64); err != nil {
+			return fmt.Errorf("invalid history entry ID %q", args[0])
+		}
+	}
+	entries, err := history.Open(cfg.StateDirectory()).Query(query)
+	if err != nil {
+		return err
+	}
+	if query.ID != 0 {
+		if len(entries) == 0 {
+			return fmt.Errorf("history entry %d not found", query.ID)
+		}
+		opts := historyArguments.Output
+		opts.DefaultFormat = "yaml"
+		return output.Print(entries[0], opts)
+	}
+	return output.Print(entries, historyArguments.Output)
+}
@@ -0,0 +1,268 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/output"
+	"zxcvmk/pkg/providers"
+)
+
+// SnapshotFilter selects snapshots by their metadata. Paths are filtered by
+// the provider, see BackupArguments.Paths.
+type SnapshotFilter struct {
+	Hosts []string
+	Tags  []string
+	// Since and Until bound the snapshot time. They accept RFC3339 times,
+	// dates (2006-01-02) and durations relative to now (36h, 7d).
+	Since string
+	Until string
+}
+
+// SnapshotGroup holds the statistics of a group of snapshots.
+type SnapshotGroup struct {
+	Group  string `json:"group"`
+	Count  int    `json:"count"`
+	Newest string `json:"newest" output:"time"`
+	Oldest string `json:"oldest" output:"time"`
+	// Size is the deduplicated data the snapshots reference in their
+	// repositories, only computed with --size.
+	Size      providers.ByteSize    `json:"size,omitempty"`
+	GapCount  int                   `json:"gapCount"`
+	Gaps      []Gap                 `json:"gaps" output:"wide"`
+	Snapshots []*providers.Snapshot `json:"snapshots" output:"-"`
+}
+
+// Gap is a period in which an expected snapshot is missing.
+type Gap struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Missing int    `json:"missing"`
+}
+
+func (g Gap) String() string {
+	return fmt.Sprintf("%s..%s (%d missing)", g.From, g.To, g.Missing)
+}
+
+// List prints the snapshots matching the filters, or per group statistics
+// with --group-by or --stats.
+func List(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) error {
+	repos, err := setupRepositories(ctx, cfg, backupArguments)
+	if err != nil {
+		return err
+	}
+	snapshots, err := listSnapshots(ctx, repos, backupArguments.Paths)
+	if err != nil {
+		return err
+	}
+	snapshots, err = filterSnapshots(snapshots, backupArguments.Filter, time.Now())
+	if err != nil {
+		return err
+	}
+	if backupArguments.GroupBy == "" && !backupArguments.Stats {
+		if backupArguments.Sizes {
+			addSnapshotSizes(ctx, repos, snapshots)
+		}
+		return output.Print(snapshots, backupArguments.Output)
+	}
+	groups, err := groupSnapshots(snapshots, backupArguments.GroupBy, backupArguments.ExpectEvery, time.Now())
+	if err != nil {
+		return err
+	}
+	if backupArguments.Sizes {
+		addGroupSizes(ctx, repos, groups)
+	}
+	return output.Print(groups, backupArguments.Output)
+}
+
+func filterSnapshots(snapshots []*providers.Snapshot, filter SnapshotFilter, now time.Time) ([]*providers.Snapshot, error) {
+	since, err := parseTimeSpec(filter.Since, now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --since: %w", err)
+	}
+	until, err := parseTimeSpec(filter.Until, now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --until: %w", err)
+	}
+	filtered := []*providers.Snapshot{}
+	for _, snapshot := range snapshots {
+		if len(filter.Hosts) > 0 && !slices.Contains(filter.Hosts, snapshot.Hostname) {
+			continue
+		}
+		if len(filter.Tags) > 0 && !slices.ContainsFunc(filter.Tags, func(tag string) bool { return slices.Contains(snapshot.Tags, tag) }) {
+			continue
+		}
+		if !since.IsZero() || !until.IsZero() {
+			t, err := snapshot.Timestamp()
+			if err != nil {
+				return nil, err
+			}
+			if (!since.IsZero() && t.Before(since)) || (!until.IsZero() && t.After(until)) {
+				continue
+			}
+		}
+		filtered = append(filtered, snapshot)
+	}
+	return filtered, nil
+}
+
+// parseTimeSpec parses an absolute time, a date or a duration before now.
+// Durations additionally accept a "d" suffix for days.
+func parseTimeSpec(spec string, now time.Time) (time.Time, error) {
+	if spec == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, spec, time.Local); err == nil {
+		return t, nil
+	}
+	d, err := config.ParseDuration(spec)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a time, a date nor a duration", spec)
+	}
+	return now.Add(-d), nil
+}
+
+// addSnapshotSizes fills in the size of snapshots without a summary, if
+// their provider can compute it.
+func addSnapshotSizes(ctx context.Context, repos []repository, snapshots []*providers.Snapshot) {
+	for _, snapshot := range snapshots {
+		if snapshot.Size > 0 {
+			continue
+		}
+		i := slices.IndexFunc(repos, func(r repository) bool { return r.Name == snapshot.Repository })
+		if i < 0 {
+			continue
+		}
+		sizer, ok := repos[i].Provider.(providers.SizeReporter)
+		if !ok {
+			continue
+		}
+		size, err := sizer.SnapshotSize(ctx, snapshot.ID)
+		if err != nil {
+			slog.Warn("cannot determine snapshot size", "snapshot", snapshot.ShortID, "error", err)
+			continue
+		}
+		snapshot.Size = providers.ByteSize(size)
+	}
+}
+
+// addGroupSizes fills in the size of the data referenced by the snapshots of
+// every group. The snapshot sizes cannot be added up, as snapshots share most
+// of their data. Repositories do not share data, so their sizes are.
+func addGroupSizes(ctx context.Context, repos []repository, groups []*SnapshotGroup) {
+	for _, group := range groups {
+		ids := map[string][]string{}
+		for _, snapshot := range group.Snapshots {
+			ids[snapshot.Repository] = append(ids[snapshot.Repository], snapshot.ID)
+		}
+		var size uint64
+		for _, repo := range repos {
+			if len(ids[repo.Name]) == 0 {
+				continue
+			}
+			sizer, ok := repo.Provider.(providers.RepositorySizer)
+			if !ok {
+				size = 0
+				break
+			}
+			repoSize, err := sizer.RepositorySize(ctx, ids[repo.Name]...)
+			if err != nil {
+				slog.Warn("cannot determine snapshot group size", "group", group.Group, "repository", repo.Name, "error", err)
+				size = 0
+				break
+			}
+			size += repoSize
+		}
+		group.Size = providers.ByteSize(size)
+	}
+}
+
+func groupKey(snapshot *providers.Snapshot, groupBy string) (string, error) {
+	switch groupBy {
+	case "", "none":
+		return "all", nil
+	case "path", "paths":
+		return strings.Join(sortedCopy(snapshot.Paths), ","), nil
+	case "host":
+		return snapshot.Hostname, nil
+	case "repository", "repo":
+		return snapshot.Repository, nil
+	}
+	return "", fmt.Errorf("cannot group by %q, expected path, host or repository", groupBy)
+}
+
+// groupSnapshots groups the snapshots and computes the statistics of every
+// group. Gaps are periods longer than expectEvery without a snapshot, up to
+// now.
+func groupSnapshots(snapshots []*providers.Snapshot, groupBy string, expectEvery time.Duration, now time.Time) ([]*SnapshotGroup, error) {
+	groups := []*SnapshotGroup{}
+	byKey := map[string]*SnapshotGroup{}
+	for _, snapshot := range snapshots {
+		key, err := groupKey(snapshot, groupBy)
+		if err != nil {
+			return nil, err
+		}
+		group, ok := byKey[key]
+		if !ok {
+			group = &SnapshotGroup{Group: key}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.Snapshots = append(group.Snapshots, snapshot)
+	}
+	for _, group := range groups {
+		if err := group.computeStats(expectEvery, now); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func (g *SnapshotGroup) computeStats(expectEvery time.Duration, now time.Time) error {
+	times := make([]time.Time, 0, len(g.Snapshots))
+	for _, snapshot := range g.Snapshots {
+		t, err := snapshot.Timestamp()
+		if err != nil {
+			return err
+		}
+		times = append(times, t)
+	}
+	slices.SortFunc(times, func(a, b time.Time) int { return a.Compare(b) })
+	g.Count = len(times)
+	g.Gaps = []Gap{}
+	if len(times) == 0 {
+		return nil
+	}
+	g.Oldest = times[0].Format(time.RFC3339)
+	g.Newest = times[len(times)-1].Format(time.RFC3339)
+	if expectEvery <= 0 {
+		return nil
+	}
+	// the period since the newest snapshot counts as a gap as well. Snapshots
+	// are matched to the nearest expected slot, so jitter does not count as a
+	// missing snapshot.
+	for i, t := range append(times, now) {
+		if i == 0 {
+			continue
+		}
+		prev := times[i-1]
+		missing := int((t.Sub(prev)+expectEvery/2)/expectEvery) - 1
+		if missing < 1 {
+			continue
+		}
+		g.Gaps = append(g.Gaps, Gap{
+			From:    prev.Format(time.RFC3339),
+			To:      t.Format(time.RFC3339),
+			Missing: missing,
+		})
+	}
+	g.GapCount = len(g.Gaps)
+	return nil
+}
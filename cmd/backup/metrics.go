@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"context"
+	"log/slog"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/metrics"
+	"zxcvmk/pkg/providers"
+)
+
+// CollectMetrics adds the snapshot and repository gauges of all backup
+// targets to set.
+func CollectMetrics(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, set *metrics.Set) {
+	for _, status := range checkTargets(ctx, cfg, backupArguments, time.Now()) {
+		labels := []string{"target", status.Location, "repository", status.Repository}
+		set.Gauge("zxcvmk_target_status", "Freshness of the latest snapshot: 0 OK, 1 warning, 2 critical, 3 unknown.", float64(status.State), labels...)
+		if status.State == StateUnknown {
+			continue
+		}
+		set.Gauge("zxcvmk_snapshots", "Number of snapshots of the target.", float64(status.Snapshots), labels...)
+		if status.Snapshots == 0 {
+			continue
+		}
+		if latest, err := time.Parse(time.RFC3339Nano, status.LatestTime); err == nil {
+			set.Gauge("zxcvmk_snapshot_last_timestamp_seconds", "Time of the latest snapshot of the target.", float64(latest.Unix()), labels...)
+		}
+		if status.LatestSize > 0 {
+			set.Gauge("zxcvmk_snapshot_last_size_bytes", "Size of the latest snapshot of the target.", float64(status.LatestSize), labels...)
+		}
+	}
+
+	repoArguments := backupArguments
+	if len(repoArguments.Repositories) == 0 {
+		repoArguments.Repositories = []string{allRepositories}
+	}
+	for _, name := range repositoryNames(cfg, repoArguments) {
+		provider, err := setupBackupProvider(ctx, cfg, name, backupArguments)
+		up := err == nil
+		if err == nil {
+			if sizer, ok := provider.(providers.RepositorySizer); ok {
+				size, sizeErr := sizer.RepositorySize(ctx)
+				if sizeErr != nil {
+					slog.Warn("could not get repository size", "repository", name, "error", sizeErr)
+					up = false
+				} else {
+					set.Gauge("zxcvmk_repository_size_bytes", "Size of the repository data.", float64(size), "repository", name)
+				}
+			}
+		} else {
+			slog.Warn("could not set up repository", "repository", name, "error", err)
+		}
+		set.Gauge("zxcvmk_repository_up", "Whether the repository could be read.", metrics.Bool(up), "repository", name)
+	}
+}
@@ -0,0 +1,30 @@
+package backup
+
+import (
+	"context"
+	"log/slog"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/notify"
+)
+
+// notifyEvent sends event to the configured notifiers, with the dispatcher
+// of the run. Notifications are best effort: failures are logged and never
+// fail the command.
+func notifyEvent(ctx context.Context, cfg *config.Config, event notify.Event) {
+	// interrupted operations are worth a notification too
+	ctx = context.WithoutCancel(ctx)
+	r := currentRun(ctx, cfg)
+	r.dispatcherOnce.Do(func() {
+		var err error
+		r.dispatcher, err = notify.New(ctx, cfg, r.secrets)
+		if err != nil {
+			slog.Warn("could not set up notifications", "error", err)
+		}
+	})
+	if r.dispatcher == nil {
+		return
+	}
+	if err := r.dispatcher.Emit(ctx, event); err != nil {
+		slog.Warn("could not send notification", "event", event.Type, "error", err)
+	}
+}
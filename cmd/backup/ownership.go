@@ -0,0 +1,173 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/providers"
+)
+
+// maxOwnershipMismatches limits the files listed in a restore report, the
+// report still counts all of them.
+const maxOwnershipMismatches = 100
+
+// OwnershipMismatch is a restored file whose owner differs from the one in
+// the snapshot, after mapping.
+type OwnershipMismatch struct {
+	Path        string `json:"path"`
+	ExpectedUID int    `json:"expectedUid"`
+	ExpectedGID int    `json:"expectedGid"`
+	UID         int    `json:"uid"`
+	GID         int    `json:"gid"`
+}
+
+// restoreOptions returns the restore options of the first path's target
+// with the ones given on the command line added.
+func restoreOptions(cfg *config.Config, backupArguments BackupArguments) (config.RestoreOptions, error) {
+	var opts config.RestoreOptions
+	if len(backupArguments.Paths) > 0 {
+		opts = cfg.RestoreOptions(backupArguments.Paths[0])
+	}
+	flags := backupArguments.RestoreOptions
+	opts.ACLs = opts.ACLs || flags.ACLs
+	opts.Xattrs = opts.Xattrs || flags.Xattrs
+	opts.HardLinks = opts.HardLinks || flags.HardLinks
+	opts.NumericIDs = opts.NumericIDs || flags.NumericIDs
+	if flags.Verify != "" {
+		if !slices.Contains(config.VerifyModes, flags.Verify) {
+			return opts, fmt.Errorf("invalid --verify %q, use one of %s", flags.Verify, strings.Join(config.VerifyModes, ", "))
+		}
+		opts.Verify = flags.Verify
+	}
+	opts.StrictVerify = opts.StrictVerify || flags.StrictVerify
+	if opts.StrictVerify && opts.Verify == "" {
+		opts.Verify = config.VerifyFiles
+	}
+	var err error
+	if opts.UIDMap, err = addIDMap(opts.UIDMap, backupArguments.MapUIDs); err != nil {
+		return opts, fmt.Errorf("invalid --map-uid: %w", err)
+	}
+	if opts.GIDMap, err = addIDMap(opts.GIDMap, backupArguments.MapGIDs); err != nil {
+		return opts, fmt.Errorf("invalid --map-gid: %w", err)
+	}
+	return opts, nil
+}
+
+// addIDMap returns a copy of ids with the FROM:TO pairs added.
+func addIDMap(ids map[int]int, pairs []string) (map[int]int, error) {
+	if len(pairs) == 0 {
+		return ids, nil
+	}
+	result := maps.Clone(ids)
+	if result == nil {
+		result = map[int]int{}
+	}
+	for _, pair := range pairs {
+		from, to, ok := strings.Cut(pair, ":")
+		fromID, fromErr := strconv.Atoi(from)
+		toID, toErr := strconv.Atoi(to)
+		if !ok || fromErr != nil || toErr != nil || fromID < 0 || toID < 0 {
+			return nil, fmt.Errorf("%q is not FROM:TO", pair)
+		}
+		result[fromID] = toID
+	}
+	return result, nil
+}
+
+func rsyncFlags(opts config.RestoreOptions) []string {
+	flags := []string{"-a"}
+	if opts.ACLs {
+		flags = append(flags, "-A")
+	}
+	if opts.Xattrs {
+		flags = append(flags, "-X")
+	}
+	if opts.HardLinks {
+		flags = append(flags, "-H")
+	}
+	if opts.NumericIDs {
+		flags = append(flags, "--numeric-ids")
+	}
+	return flags
+}
+
+func mapID(ids map[int]int, id int) int {
+	if mapped, ok := ids[id]; ok {
+		return mapped
+	}
+	return id
+}
+
+// remapOwnership changes the owner of path and everything below it
+// according to the ID maps.
+func remapOwnership(ctx context.Context, path string, opts config.RestoreOptions) error {
+	if len(opts.UIDMap) == 0 && len(opts.GIDMap) == 0 {
+		return nil
+	}
+	return filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		uid, gid := mapID(opts.UIDMap, int(st.Uid)), mapID(opts.GIDMap, int(st.Gid))
+		if uid == int(st.Uid) && gid == int(st.Gid) {
+			return nil
+		}
+		// a failure shows up as a mismatch in checkOwnership
+		_ = os.Lchown(file, uid, gid)
+		return nil
+	})
+}
+
+// checkOwnership compares the owners of the restored files with the ones
+// recorded in the snapshot, after mapping. It returns the first mismatches
+// and their total count.
+func checkOwnership(ctx context.Context, walker providers.Walker, snapshot *providers.Snapshot, paths []string, opts config.RestoreOptions) ([]OwnershipMismatch, int, error) {
+	var mismatches []OwnershipMismatch
+	count := 0
+	for _, path := range paths {
+		err := walker.WalkFiles(ctx, snapshot.ID, path, func(file *providers.File) error {
+			var st syscall.Stat_t
+			if err := syscall.Lstat(file.Path, &st); err != nil {
+				// deleted or replaced since, not an ownership problem
+				return nil
+			}
+			expected := OwnershipMismatch{
+				Path:        file.Path,
+				ExpectedUID: mapID(opts.UIDMap, file.UID),
+				ExpectedGID: mapID(opts.GIDMap, file.GID),
+				UID:         int(st.Uid),
+				GID:         int(st.Gid),
+			}
+			if expected.UID != expected.ExpectedUID || expected.GID != expected.ExpectedGID {
+				count++
+				if len(mismatches) < maxOwnershipMismatches {
+					mismatches = append(mismatches, expected)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return mismatches, count, err
+		}
+	}
+	return mismatches, count, nil
+}
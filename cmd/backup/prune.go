@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/history"
+	"zxcvmk/pkg/providers"
+)
+
+// Prune removes the snapshots outside of the retention policy from the
+// selected repositories.
+func Prune(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) error {
+	retention := backupArguments.Retention
+	if retention == nil {
+		retention = cfg.Retention
+	}
+	if retention == nil || retention.IsZero() {
+		return errors.New("no retention configured, refusing to prune")
+	}
+	repos, err := setupRepositories(ctx, cfg, backupArguments)
+	if err != nil {
+		return err
+	}
+	opts := providers.PruneOptions{
+		KeepLast:    retention.KeepLast,
+		KeepHourly:  retention.KeepHourly,
+		KeepDaily:   retention.KeepDaily,
+		KeepWeekly:  retention.KeepWeekly,
+		KeepMonthly: retention.KeepMonthly,
+		KeepYearly:  retention.KeepYearly,
+		KeepWithin:  retention.KeepWithin,
+		Paths:       backupArguments.Paths,
+		DryRun:      backupArguments.DryRun,
+	}
+	var errs []error
+	for _, repo := range repos {
+		pruner, ok := repo.Provider.(providers.Pruner)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: backup provider does not support pruning", repo.Name))
+			continue
+		}
+		slog.Info("pruning repository", "repository", repo.Name, "retention", *retention, "dryRun", opts.DryRun)
+		entry := history.NewEntry("prune", repo.Name)
+		entry.Repository = repo.Name
+		err := pruner.Prune(ctx, opts)
+		if !opts.DryRun {
+			recordRun(ctx, cfg, entry, err)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", repo.Name, describeLocks(ctx, repo.Provider, err)))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,199 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/output"
+	"zxcvmk/pkg/providers"
+)
+
+// replicatedFromTag marks snapshots created by the generic copy, which
+// cannot preserve the tree and paths of the source snapshot.
+const replicatedFromTag = "replicated-from:"
+
+// ReplicationReport describes how far the destination repository lags behind
+// the source.
+type ReplicationReport struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+	// Missing are the source snapshots not present in the destination.
+	Missing []*providers.Snapshot `json:"missing" yaml:"missing"`
+	// Lag is the age of the oldest missing snapshot.
+	Lag           string `json:"lag" yaml:"lag"`
+	NewestSource  string `json:"newestSource,omitempty" yaml:"newestSource,omitempty"`
+	NewestReplica string `json:"newestReplica,omitempty" yaml:"newestReplica,omitempty"`
+}
+
+// Replicate copies the snapshots missing in the --to repository from the
+// --from repository and reports the remaining replication lag. With
+// --dry-run only the lag is reported.
+func Replicate(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) error {
+	if backupArguments.From == "" || backupArguments.To == "" {
+		return errors.New("both --from and --to repositories are required")
+	}
+	from, err := setupBackupProvider(ctx, cfg, backupArguments.From, backupArguments)
+	if err != nil {
+		return err
+	}
+	to, err := setupBackupProvider(ctx, cfg, backupArguments.To, backupArguments)
+	if err != nil {
+		return err
+	}
+	src := repository{Name: backupArguments.From, Provider: from}
+	dst := repository{Name: backupArguments.To, Provider: to}
+
+	report, err := replicationReport(ctx, src, dst, backupArguments.Paths)
+	if err != nil {
+		return err
+	}
+	if !backupArguments.DryRun && len(report.Missing) > 0 {
+		slog.Info("replicating snapshots", "from", src.Name, "to", dst.Name, "count", len(report.Missing))
+		if err = copySnapshots(ctx, src, dst, report.Missing, cfg.StagingDirectory("")); err != nil {
+			return fmt.Errorf("replication from %s to %s failed: %w", src.Name, dst.Name, err)
+		}
+		report, err = replicationReport(ctx, src, dst, backupArguments.Paths)
+		if err != nil {
+			return err
+		}
+	}
+	return output.Print(report, backupArguments.Output)
+}
+
+func replicationReport(ctx context.Context, src, dst repository, filterPaths []string) (*ReplicationReport, error) {
+	srcSnapshots, err := listSnapshots(ctx, []repository{src}, filterPaths)
+	if err != nil {
+		return nil, err
+	}
+	dstSnapshots, err := listSnapshots(ctx, []repository{dst}, filterPaths)
+	if err != nil {
+		return nil, err
+	}
+	report := &ReplicationReport{From: src.Name, To: dst.Name, Missing: []*providers.Snapshot{}}
+	if newest := newestSnapshot(srcSnapshots); newest != nil {
+		report.NewestSource = newest.Time
+	}
+	if newest := newestSnapshot(dstSnapshots); newest != nil {
+		report.NewestReplica = newest.Time
+	}
+	var oldestMissing time.Time
+	for _, snapshot := range srcSnapshots {
+		if slices.ContainsFunc(dstSnapshots, func(s *providers.Snapshot) bool { return snapshotsMatch(snapshot, s) }) {
+			continue
+		}
+		report.Missing = append(report.Missing, snapshot)
+		if t, err := snapshot.Timestamp(); err == nil && (oldestMissing.IsZero() || t.Before(oldestMissing)) {
+			oldestMissing = t
+		}
+	}
+	report.Lag = "0s"
+	if !oldestMissing.IsZero() {
+		report.Lag = time.Since(oldestMissing).Round(time.Second).String()
+	}
+	return report, nil
+}
+
+// snapshotsMatch reports whether replica is a copy of snapshot. Native copies
+// keep the tree, time, host and paths, generic copies carry a tag naming
+// their source. The tree alone does not identify a snapshot, backups of
+// unchanged data share it.
+func snapshotsMatch(snapshot, replica *providers.Snapshot) bool {
+	if slices.Contains(replica.Tags, replicatedFromTag+snapshot.ID) {
+		return true
+	}
+	if snapshot.Tree != "" && replica.Tree != "" && snapshot.Tree != replica.Tree {
+		return false
+	}
+	st, err := snapshot.Timestamp()
+	if err != nil {
+		return false
+	}
+	rt, err := replica.Timestamp()
+	if err != nil {
+		return false
+	}
+	return st.Truncate(time.Second).Equal(rt.Truncate(time.Second)) &&
+		snapshot.Hostname == replica.Hostname &&
+		slices.Equal(sortedCopy(snapshot.Paths), sortedCopy(replica.Paths))
+}
+
+func sortedCopy(s []string) []string {
+	s = slices.Clone(s)
+	slices.Sort(s)
+	return s
+}
+
+func newestSnapshot(snapshots []*providers.Snapshot) *providers.Snapshot {
+	var newest *providers.Snapshot
+	var newestTime time.Time
+	for _, snapshot := range snapshots {
+		t, err := snapshot.Timestamp()
+		if err != nil {
+			continue
+		}
+		if newest == nil || t.After(newestTime) {
+			newest, newestTime = snapshot, t
+		}
+	}
+	return newest
+}
+
+// copySnapshots copies natively when the destination provider supports it,
+// and snapshot by snapshot through a staging directory otherwise.
+func copySnapshots(ctx context.Context, src, dst repository, snapshots []*providers.Snapshot, stagingDir string) error {
+	if copier, ok := dst.Provider.(providers.Copier); ok {
+		ids := make([]string, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			ids = append(ids, snapshot.ID)
+		}
+		err := copier.CopySnapshots(ctx, src.Provider, ids)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+	for _, snapshot := range snapshots {
+		if err := copySnapshotGeneric(ctx, src, dst, snapshot, stagingDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copySnapshotGeneric restores the snapshot into a staging directory and
+// backs it up again into dst, keeping its time, host and tags.
+func copySnapshotGeneric(ctx context.Context, src, dst repository, snapshot *providers.Snapshot, stagingDir string) error {
+	backuper, ok := dst.Provider.(providers.Backuper)
+	if !ok {
+		return fmt.Errorf("repository %s cannot create snapshots", dst.Name)
+	}
+	snapshotTime, err := snapshot.Timestamp()
+	if err != nil {
+		return err
+	}
+	staging, err := createSnapshotMountTarget(stagingDir)
+	if err != nil {
+		return fmt.Errorf("staging directory could not be created: %w", err)
+	}
+	defer func() {
+		_ = deleteSnapshotMountTarget(staging)
+	}()
+	slog.Info("copying snapshot", "snapshot", snapshot.ShortID, "from", src.Name, "to", dst.Name)
+	if err = src.Provider.RestoreSnapshot(ctx, snapshot.ID, staging, nil, nil); err != nil {
+		return fmt.Errorf("cannot restore snapshot %s: %w", snapshot.ShortID, err)
+	}
+	paths := make([]string, 0, len(snapshot.Paths))
+	for _, path := range snapshot.Paths {
+		paths = append(paths, strings.TrimPrefix(path, "/"))
+	}
+	return backuper.Backup(ctx, paths, providers.BackupOptions{
+		Dir:  staging,
+		Host: snapshot.Hostname,
+		Time: snapshotTime,
+		Tags: append(slices.Clone(snapshot.Tags), replicatedFromTag+snapshot.ID),
+	})
+}
@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/notify"
+	"zxcvmk/pkg/providers"
+	"zxcvmk/pkg/secrets"
+)
+
+// allRepositories selects every configured repository when passed to --repo.
+const allRepositories = "all"
+
+// repository is a configured, named backup repository.
+type repository struct {
+	Name     string
+	Provider providers.BackupProvider
+}
+
+// repositoryNames resolves which repositories a command operates on: the
+// ones given with --repo, otherwise the ones the filtered targets are stored
+// in, otherwise the default backupProvider.
+func repositoryNames(cfg *config.Config, backupArguments BackupArguments) []string {
+	if slices.Contains(backupArguments.Repositories, allRepositories) {
+		var names []string
+		for _, provider := range cfg.BackupProviders {
+			names = append(names, provider.Name)
+		}
+		return names
+	}
+	if len(backupArguments.Repositories) > 0 {
+		return backupArguments.Repositories
+	}
+	var names []string
+	for _, path := range backupArguments.Paths {
+		for _, name := range cfg.TargetRepositories(path) {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, cfg.BackupProvider)
+	}
+	return names
+}
+
+func setupRepositories(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) ([]repository, error) {
+	var repos []repository
+	for _, name := range repositoryNames(cfg, backupArguments) {
+		provider, err := setupBackupProvider(ctx, cfg, name, backupArguments)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, repository{Name: name, Provider: provider})
+	}
+	return repos, nil
+}
+
+// run is what the commands of one run share: the secret resolver, so that
+// every secret is only fetched once, and the notification dispatcher.
+type run struct {
+	cfg            *config.Config
+	secrets        *secrets.Resolver
+	dispatcher     *notify.Dispatcher
+	dispatcherOnce sync.Once
+}
+
+type runKey struct{}
+
+// WithRun starts a run on ctx. Secrets are fetched again in the next run, so
+// long running processes start one per job or request to pick up rotated
+// passwords and keys.
+func WithRun(ctx context.Context, cfg *config.Config) context.Context {
+	return context.WithValue(ctx, runKey{}, &run{cfg: cfg, secrets: secrets.NewResolver(cfg.AgeKeyFile)})
+}
+
+// currentRun returns the run started on ctx, or a run of its own for a
+// caller that did not start one.
+func currentRun(ctx context.Context, cfg *config.Config) *run {
+	if r, ok := ctx.Value(runKey{}).(*run); ok && r.cfg == cfg {
+		return r
+	}
+	return &run{cfg: cfg, secrets: secrets.NewResolver(cfg.AgeKeyFile)}
+}
+
+func resolveSecret(ctx context.Context, cfg *config.Config, ref string) (secrets.Secret, error) {
+	return currentRun(ctx, cfg).secrets.Resolve(ctx, ref)
+}
+
+func setupBackupProvider(ctx context.Context, cfg *config.Config, name string, backupArguments BackupArguments) (providers.BackupProvider, error) {
+	provider, ok := cfg.Repository(name)
+	if !ok {
+		return nil, fmt.Errorf("repository %q is not configured", name)
+	}
+	retryLock := backupArguments.RetryLock
+	if retryLock == 0 && provider.RetryLock != "" {
+		var err error
+		retryLock, err = time.ParseDuration(provider.RetryLock)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retryLock for repository %s: %w", provider.Name, err)
+		}
+	}
+	switch provider.ProviderType() {
+	case "restic":
+		password, err := resolveSecret(ctx, cfg, provider.BackupRepositoryPasswordLocation)
+		if err != nil {
+			return nil, fmt.Errorf("repository %s: %w", provider.Name, err)
+		}
+		resticProvider := providers.NewResticProvider(password, provider.BackupRepository)
+		resticProvider.RetryLock = retryLock
+		return resticProvider, nil
+	}
+	return nil, fmt.Errorf("unsupported backup provider %q for repository %s", provider.ProviderType(), provider.Name)
+}
+
+// listSnapshots merges the snapshots of all repositories, recording on each
+// snapshot which repository it came from.
+func listSnapshots(ctx context.Context, repos []repository, filterPaths []string) ([]*providers.Snapshot, error) {
+	var all []*providers.Snapshot
+	for _, repo := range repos {
+		snapshots, err := repo.Provider.ListSnapshots(ctx, filterPaths)
+		if err != nil {
+			return nil, fmt.Errorf("error listing snapshots in %s: %w", repo.Name, describeLocks(ctx, repo.Provider, err))
+		}
+		for _, snapshot := range snapshots {
+			snapshot.Repository = repo.Name
+		}
+		all = append(all, snapshots...)
+	}
+	return all, nil
+}
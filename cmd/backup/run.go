@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/history"
+	"zxcvmk/pkg/providers"
+)
+
+// selectedTargets returns the backup targets at paths, or all of them
+// without paths.
+func selectedTargets(cfg *config.Config, paths []string) ([]config.BackupTarget, error) {
+	if len(paths) == 0 {
+		return cfg.BackupTargets, nil
+	}
+	var targets []config.BackupTarget
+	for _, path := range paths {
+		found := false
+		for _, target := range cfg.BackupTargets {
+			if target.Location == path {
+				targets = append(targets, target)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s is not a backup target", providers.ErrTargetMissing, path)
+		}
+	}
+	return targets, nil
+}
+
+// targetRepositories returns the repositories a target is backed up to,
+// honouring --repo.
+func targetRepositories(cfg *config.Config, backupArguments BackupArguments, location string) []string {
+	return repositoryNames(cfg, BackupArguments{Repositories: backupArguments.Repositories, Paths: []string{location}})
+}
+
+// Run backs up the selected targets, all without --filter-path, into each of
+// their repositories.
+func Run(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) error {
+	targets, err := selectedTargets(cfg, backupArguments.Paths)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, target := range targets {
+		repoNames := targetRepositories(cfg, backupArguments, target.Location)
+		entry := history.NewEntry("backup", target.Location)
+		entry.Repository = strings.Join(repoNames, ",")
+		var targetErrs []error
+		for _, name := range repoNames {
+			if err := backupTarget(ctx, cfg, backupArguments, target.Location, name); err != nil {
+				targetErrs = append(targetErrs, fmt.Errorf("%s to %s: %w", target.Location, name, err))
+			}
+		}
+		err := errors.Join(targetErrs...)
+		recordRun(ctx, cfg, entry, err)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if ctx.Err() != nil {
+			return errors.Join(append(errs, fmt.Errorf("%w: %w", providers.ErrInterrupted, ctx.Err()))...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func backupTarget(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, location, repoName string) error {
+	provider, err := setupBackupProvider(ctx, cfg, repoName, backupArguments)
+	if err != nil {
+		return err
+	}
+	backuper, ok := provider.(providers.Backuper)
+	if !ok {
+		return fmt.Errorf("backup provider of %s cannot create snapshots", repoName)
+	}
+	slog.Info("backing up", "path", location, "repository", repoName)
+	started := time.Now()
+	if err := backuper.Backup(ctx, []string{location}, providers.BackupOptions{}); err != nil {
+		return describeLocks(ctx, provider, err)
+	}
+	slog.Info("backup complete", "path", location, "repository", repoName, "duration", time.Since(started).Round(time.Second))
+	return nil
+}
@@ -0,0 +1,325 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"zxcvmk/pkg/progress"
+	"zxcvmk/pkg/providers"
+)
+
+// errNoSpace is returned when the staging or destination filesystem cannot
+// hold the restore.
+var errNoSpace = errors.New("not enough free space")
+
+// createSnapshotMountTarget creates a staging directory below dir, which is
+// created if it does not exist.
+func createSnapshotMountTarget(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(dir, "snapshot-")
+}
+
+func deleteSnapshotMountTarget(target string) error {
+	err := os.RemoveAll(target)
+	if err != nil {
+		slog.Error("error when removeall", "target", target, "error", err)
+		return err
+	}
+	return nil
+}
+
+// filesystem is the free space and device of the filesystem holding a
+// path.
+type filesystem struct {
+	Path string
+	Free uint64
+	Dev  uint64
+}
+
+// statFilesystem returns the filesystem of path, or of its closest existing
+// parent if it does not exist yet.
+func statFilesystem(path string) (filesystem, error) {
+	for {
+		var st syscall.Stat_t
+		err := syscall.Stat(path, &st)
+		if err == nil {
+			var sfs syscall.Statfs_t
+			if err := syscall.Statfs(path, &sfs); err != nil {
+				return filesystem{}, fmt.Errorf("cannot get free space of %s: %w", path, err)
+			}
+			return filesystem{Path: path, Free: uint64(sfs.Bavail) * uint64(sfs.Bsize), Dev: uint64(st.Dev)}, nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, syscall.ENOENT) || parent == path {
+			return filesystem{}, fmt.Errorf("cannot stat %s: %w", path, err)
+		}
+		path = parent
+	}
+}
+
+// restoreSize estimates the size of restoring paths from snapshot. Parts of
+// the snapshot are measured from the sizes of their files, the whole
+// snapshot from its summary or by asking the provider. 0 means unknown.
+func restoreSize(ctx context.Context, repo repository, snapshot *providers.Snapshot, paths []string) uint64 {
+	if walker, ok := repo.Provider.(providers.Walker); ok && !slices.Equal(sortedCopy(paths), sortedCopy(snapshot.Paths)) {
+		var size uint64
+		var err error
+		for _, path := range paths {
+			err = walker.WalkFiles(ctx, snapshot.ID, path, func(file *providers.File) error {
+				if file.Type == "file" {
+					size += uint64(file.Size)
+				}
+				return nil
+			})
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return size
+		}
+		slog.Warn("cannot measure the restored paths, using the snapshot size", "snapshot", snapshot.ShortID, "error", err)
+	}
+	if snapshot.Size > 0 {
+		return uint64(snapshot.Size)
+	}
+	sizer, ok := repo.Provider.(providers.SizeReporter)
+	if !ok {
+		return 0
+	}
+	size, err := sizer.SnapshotSize(ctx, snapshot.ID)
+	if err != nil {
+		slog.Warn("cannot estimate the restore size", "snapshot", snapshot.ShortID, "error", err)
+		return 0
+	}
+	return size
+}
+
+// diskUsage returns the size of the regular files below path, 0 if it does
+// not exist.
+func diskUsage(path string) uint64 {
+	var size uint64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += uint64(info.Size())
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// stagingPlan is where a restore is staged and which of its paths can be
+// moved into place instead of copied.
+type stagingPlan struct {
+	Dir string
+	// Move holds the paths on the same filesystem as Dir.
+	Move []string
+}
+
+// spaceLedger holds the staging space reserved by the restores running at
+// the same time, the free space only shows what they wrote so far.
+type spaceLedger struct {
+	mu       sync.Mutex
+	reserved map[uint64]uint64
+}
+
+func newSpaceLedger() *spaceLedger {
+	return &spaceLedger{reserved: map[uint64]uint64{}}
+}
+
+// reserve reserves size bytes of the free bytes of filesystem dev if the
+// other reservations leave room for them. It returns the release of the
+// reservation and the bytes reserved by others.
+func (l *spaceLedger) reserve(dev, free, size uint64) (func(), uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	others := l.reserved[dev]
+	if free < others || free-others < size {
+		return func() {}, others, false
+	}
+	l.reserved[dev] += size
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.reserved[dev] -= size
+	}, others, true
+}
+
+// planStaging checks that the staging directory and the destinations of
+// paths have room for a restore of size bytes and reserves the staging
+// space in ledger until release is called. The destinations only need room
+// for what the restore adds to their current contents, destinations on the
+// staging filesystem need none as the staged files are moved into place.
+func planStaging(dir string, paths []string, size uint64, ledger *spaceLedger) (plan stagingPlan, release func(), err error) {
+	plan = stagingPlan{Dir: dir}
+	release = func() {}
+	staging, err := statFilesystem(dir)
+	if err != nil {
+		return plan, release, err
+	}
+	var existing uint64
+	var destinations []filesystem
+	for _, path := range paths {
+		fs, err := statFilesystem(path)
+		if err != nil {
+			return plan, release, err
+		}
+		if fs.Dev == staging.Dev {
+			plan.Move = append(plan.Move, path)
+		} else if !slices.ContainsFunc(destinations, func(d filesystem) bool { return d.Dev == fs.Dev }) {
+			destinations = append(destinations, fs)
+		}
+		existing += diskUsage(path)
+	}
+	if size == 0 {
+		slog.Warn("restore size unknown, not checking free space", "stagingDir", dir)
+		return plan, release, nil
+	}
+	var problems []string
+	release, others, ok := ledger.reserve(staging.Dev, staging.Free, size)
+	if !ok {
+		problem := fmt.Sprintf("staging directory %s has %s free", dir, progress.FormatBytes(staging.Free))
+		if others > 0 {
+			problem += fmt.Sprintf(", %s of it reserved by the restores running alongside", progress.FormatBytes(others))
+		}
+		problems = append(problems, problem)
+	}
+	problems = append(problems, destinationProblems(destinations, size, existing)...)
+	if len(problems) > 0 {
+		release()
+		return plan, func() {}, fmt.Errorf("%w: the restore needs about %s, %s; set stagingDir to a larger filesystem", errNoSpace, progress.FormatBytes(size), strings.Join(problems, ", "))
+	}
+	slog.Debug("restore fits", "size", size, "stagingDir", dir, "stagingFree", staging.Free, "reserved", others, "move", plan.Move)
+	return plan, release, nil
+}
+
+// checkInPlaceSpace checks that the destinations of paths have room for
+// what an in-place restore of size bytes adds to their contents.
+func checkInPlaceSpace(paths []string, size uint64) error {
+	if size == 0 {
+		slog.Warn("restore size unknown, not checking free space")
+		return nil
+	}
+	var existing uint64
+	var destinations []filesystem
+	for _, path := range paths {
+		fs, err := statFilesystem(path)
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(destinations, func(d filesystem) bool { return d.Dev == fs.Dev }) {
+			destinations = append(destinations, fs)
+		}
+		existing += diskUsage(path)
+	}
+	if problems := destinationProblems(destinations, size, existing); len(problems) > 0 {
+		return fmt.Errorf("%w: the restore needs about %s, %s", errNoSpace, progress.FormatBytes(size), strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func destinationProblems(destinations []filesystem, size, existing uint64) []string {
+	if size <= existing {
+		return nil
+	}
+	var problems []string
+	for _, fs := range destinations {
+		if fs.Free < size-existing {
+			problems = append(problems, fmt.Sprintf("destination %s has %s free and needs %s more", fs.Path, progress.FormatBytes(fs.Free), progress.FormatBytes(size-existing)))
+		}
+	}
+	return problems
+}
+
+// moveTree moves the contents of src over dst by renaming, both have to be
+// on the same filesystem. Entries of dst that are not in src are kept, as
+// with rsync without --delete. The directories of dst take the mode,
+// ownership and times of the ones in src.
+func moveTree(ctx context.Context, src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return replaceEntry(src, dst)
+	}
+	var dirs []string
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if !d.IsDir() {
+			return replaceEntry(path, target)
+		}
+		if existing, err := os.Lstat(target); err == nil && !existing.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		if err := os.Mkdir(target, 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		dirs = append(dirs, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// children first, setting the times of a directory is undone by
+	// changes inside it
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := copyDirMetadata(filepath.Join(src, dirs[i]), filepath.Join(dst, dirs[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceEntry renames a file, symlink or special file over dst.
+func replaceEntry(src, dst string) error {
+	if existing, err := os.Lstat(dst); err == nil && existing.IsDir() {
+		if err := os.RemoveAll(dst); err != nil {
+			return err
+		}
+	}
+	return os.Rename(src, dst)
+}
+
+func copyDirMetadata(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+	if err := os.Chmod(dst, info.Mode().Perm()|info.Mode()&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,223 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/notify"
+	"zxcvmk/pkg/output"
+	"zxcvmk/pkg/providers"
+)
+
+// State is a monitoring plugin state. The values are the plugin exit codes.
+type State int
+
+const (
+	StateOK       State = 0
+	StateWarning  State = 1
+	StateCritical State = 2
+	StateUnknown  State = 3
+)
+
+func (s State) String() string {
+	switch s {
+	case StateOK:
+		return "OK"
+	case StateWarning:
+		return "WARN"
+	case StateCritical:
+		return "CRIT"
+	}
+	return "UNKNOWN"
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// severity orders states from best to worst.
+func (s State) severity() int {
+	switch s {
+	case StateOK:
+		return 0
+	case StateUnknown:
+		return 1
+	case StateWarning:
+		return 2
+	}
+	return 3
+}
+
+// TargetStatus is the freshness of a target in one repository.
+type TargetStatus struct {
+	Location    string             `json:"location"`
+	Repository  string             `json:"repository"`
+	State       State              `json:"state"`
+	LatestID    string             `json:"latestId,omitempty" output:"wide"`
+	LatestTime  string             `json:"latestTime,omitempty" output:"time"`
+	LatestSize  providers.ByteSize `json:"latestSize,omitempty" output:"wide"`
+	AgeSeconds  int64              `json:"ageSeconds"`
+	WarnSeconds int64              `json:"warnSeconds" output:"wide"`
+	CritSeconds int64              `json:"critSeconds" output:"wide"`
+	Snapshots   int                `json:"snapshots"`
+	Message     string             `json:"message"`
+}
+
+// StatusError carries the monitoring plugin exit code of a status run that
+// is not OK.
+type StatusError struct {
+	State State
+}
+
+func (e *StatusError) Error() string {
+	return "backup status is " + e.State.String()
+}
+
+// ExitCode returns the monitoring plugin exit code.
+func (e *StatusError) ExitCode() int {
+	return int(e.State)
+}
+
+// Status checks the latest snapshot of every backup target against its
+// freshness thresholds. The default output follows the Nagios plugin
+// guidelines, the returned error carries the plugin exit code.
+func Status(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) error {
+	statuses := checkTargets(ctx, cfg, backupArguments, time.Now())
+	worst := StateOK
+	for _, status := range statuses {
+		if status.State.severity() > worst.severity() {
+			worst = status.State
+		}
+		if status.State == StateWarning || status.State == StateCritical {
+			severity := notify.SeverityWarning
+			if status.State == StateCritical {
+				severity = notify.SeverityError
+			}
+			notifyEvent(ctx, cfg, notify.NewEvent("snapshot.stale", severity, status.Location,
+				fmt.Sprintf("backup of %s in %s is %s", status.Location, status.Repository, nagiosState(status.State)),
+				status.Message))
+		}
+	}
+	var err error
+	if backupArguments.Output.Format == "" || backupArguments.Output.Format == "nagios" {
+		err = writeNagios(os.Stdout, statuses, worst)
+	} else {
+		err = output.Print(statuses, backupArguments.Output)
+	}
+	if err != nil {
+		return err
+	}
+	if worst != StateOK {
+		return &StatusError{State: worst}
+	}
+	return nil
+}
+
+func checkTargets(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, now time.Time) []*TargetStatus {
+	statuses := []*TargetStatus{}
+	for _, target := range cfg.BackupTargets {
+		if len(backupArguments.Paths) > 0 && !slices.Contains(backupArguments.Paths, target.Location) {
+			continue
+		}
+		repoNames := backupArguments.Repositories
+		if len(repoNames) == 0 {
+			repoNames = cfg.TargetRepositories(target.Location)
+		}
+		warn, crit, err := cfg.Freshness(target)
+		for _, repoName := range repoNames {
+			status := &TargetStatus{
+				Location:    target.Location,
+				Repository:  repoName,
+				WarnSeconds: int64(warn.Seconds()),
+				CritSeconds: int64(crit.Seconds()),
+			}
+			statuses = append(statuses, status)
+			if err != nil {
+				status.State, status.Message = StateUnknown, err.Error()
+				continue
+			}
+			checkTarget(ctx, cfg, backupArguments, status, warn, crit, now)
+		}
+	}
+	return statuses
+}
+
+func checkTarget(ctx context.Context, cfg *config.Config, backupArguments BackupArguments, status *TargetStatus, warn, crit time.Duration, now time.Time) {
+	provider, err := setupBackupProvider(ctx, cfg, status.Repository, backupArguments)
+	if err != nil {
+		status.State, status.Message = StateUnknown, err.Error()
+		return
+	}
+	repo := repository{Name: status.Repository, Provider: provider}
+	snapshots, err := listSnapshots(ctx, []repository{repo}, []string{status.Location})
+	if err != nil {
+		status.State, status.Message = StateUnknown, err.Error()
+		return
+	}
+	status.Snapshots = len(snapshots)
+	latest := newestSnapshot(snapshots)
+	if latest == nil {
+		status.State, status.Message = StateCritical, "no snapshot found"
+		return
+	}
+	latestTime, _ := latest.Timestamp()
+	age := now.Sub(latestTime)
+	status.LatestID = latest.ShortID
+	status.LatestTime = latest.Time
+	status.LatestSize = latest.Size
+	status.AgeSeconds = int64(age.Seconds())
+	switch {
+	case age > crit:
+		status.State = StateCritical
+	case age > warn:
+		status.State = StateWarning
+	default:
+		status.State = StateOK
+	}
+	status.Message = fmt.Sprintf("latest snapshot %s is %s old", latest.ShortID, age.Round(time.Minute))
+}
+
+// writeNagios prints the plugin output: a summary line with performance
+// data, followed by one line per target.
+func writeNagios(w io.Writer, statuses []*TargetStatus, worst State) error {
+	counts := map[State]int{}
+	var perfdata []string
+	for _, status := range statuses {
+		counts[status.State]++
+		label := status.Location
+		if status.Repository != "" {
+			label += "@" + status.Repository
+		}
+		label = strings.ReplaceAll(label, "'", "_")
+		if status.State != StateUnknown && status.Snapshots > 0 {
+			perfdata = append(perfdata, fmt.Sprintf("'%s age'=%ds;%d;%d;0", label, status.AgeSeconds, status.WarnSeconds, status.CritSeconds))
+		}
+		perfdata = append(perfdata, fmt.Sprintf("'%s snapshots'=%d;;;0", label, status.Snapshots))
+	}
+	summary := fmt.Sprintf("BACKUP %s - %d critical, %d warning, %d unknown, %d ok",
+		nagiosState(worst), counts[StateCritical], counts[StateWarning], counts[StateUnknown], counts[StateOK])
+	if _, err := fmt.Fprintf(w, "%s | %s\n", summary, strings.Join(perfdata, " ")); err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if _, err := fmt.Fprintf(w, "%s: %s in %s: %s\n", status.State, status.Location, status.Repository, status.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nagiosState(s State) string {
+	switch s {
+	case StateWarning:
+		return "WARNING"
+	case StateCritical:
+		return "CRITICAL"
+	}
+	return s.String()
+}
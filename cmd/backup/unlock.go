@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/providers"
+)
+
+// Unlock removes stale repository locks. A lock is stale when it is older
+// than backupArguments.UnlockOlderThan or was created by a process on this
+// host that is no longer running. Live locks are never removed.
+func Unlock(ctx context.Context, cfg *config.Config, backupArguments BackupArguments) error {
+	repos, err := setupRepositories(ctx, cfg, backupArguments)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, repo := range repos {
+		if err = unlockRepository(ctx, repo, backupArguments); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", repo.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func unlockRepository(ctx context.Context, repo repository, backupArguments BackupArguments) error {
+	locker, ok := repo.Provider.(providers.Locker)
+	if !ok {
+		return fmt.Errorf("backup provider of %s does not support locks", repo.Name)
+	}
+	locks, err := locker.ListLocks(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot list locks: %w", err)
+	}
+	if len(locks) == 0 {
+		slog.Info("repository is not locked", "repository", repo.Name)
+		return nil
+	}
+
+	var stale, live []*providers.Lock
+	for _, lock := range locks {
+		if lock.Stale(backupArguments.UnlockOlderThan) {
+			stale = append(stale, lock)
+		} else {
+			live = append(live, lock)
+		}
+	}
+	for _, lock := range live {
+		slog.Warn("keeping live lock", "repository", repo.Name, "lock", lock.String(), "exclusive", lock.Exclusive)
+	}
+	for _, lock := range stale {
+		slog.Info("removing stale lock", "repository", repo.Name, "lock", lock.String(), "exclusive", lock.Exclusive, "dryRun", backupArguments.DryRun)
+	}
+	if backupArguments.DryRun {
+		return nil
+	}
+	if err = locker.RemoveLocks(ctx, stale); err != nil {
+		return fmt.Errorf("cannot remove locks: %w", err)
+	}
+	if len(live) > 0 {
+		return fmt.Errorf("%w: %d live lock(s) left in place", providers.ErrRepoLocked, len(live))
+	}
+	return nil
+}
+
+// describeLocks adds the lock holders to err if it was caused by a locked
+// repository.
+func describeLocks(ctx context.Context, backupProviderImpl providers.BackupProvider, err error) error {
+	locker, ok := backupProviderImpl.(providers.Locker)
+	if !ok || !errors.Is(err, providers.ErrRepoLocked) {
+		return err
+	}
+	locks, lockErr := locker.ListLocks(ctx)
+	if lockErr != nil {
+		slog.Debug("cannot list locks", "error", lockErr)
+		return err
+	}
+	for _, lock := range locks {
+		err = fmt.Errorf("%w; %s", err, lock)
+	}
+	return err
+}
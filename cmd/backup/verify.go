@@ -0,0 +1,207 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/providers"
+)
+
+// maxFileMismatches limits the differences listed in a restore report, the
+// report still counts all of them.
+const maxFileMismatches = 100
+
+// FileMismatch is a restored file that differs from the snapshot.
+type FileMismatch struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+// manifestEntry is what a file is expected to look like after the restore.
+type manifestEntry struct {
+	Kind string
+	Size int64
+	// Hash is the hex SHA-256 of a regular file, empty if not computed.
+	Hash string
+}
+
+// manifest maps the live paths of the restored files to what they are
+// expected to be.
+type manifest map[string]manifestEntry
+
+// fileKind names the type of a file the way restic does.
+func fileKind(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode.IsRegular():
+		return "file"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
+
+// stagedManifest records the files restored below root for path, which is
+// where they are put in place.
+func stagedManifest(ctx context.Context, m manifest, root, path string, hashes bool) error {
+	staged := filepath.Join(root, path)
+	return filepath.WalkDir(staged, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(staged, file)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := manifestEntry{Kind: fileKind(info.Mode()), Size: info.Size()}
+		if hashes && entry.Kind == "file" {
+			if entry.Hash, err = hashFile(file); err != nil {
+				return err
+			}
+		}
+		m[filepath.Join(path, rel)] = entry
+		return nil
+	})
+}
+
+// snapshotManifest records the files below path in the snapshot, from the
+// provider's metadata, which has no hashes.
+func snapshotManifest(ctx context.Context, m manifest, walker providers.Walker, snapshot *providers.Snapshot, path string) error {
+	return walker.WalkFiles(ctx, snapshot.ID, path, func(file *providers.File) error {
+		kind := file.Type
+		if !slices.Contains([]string{"dir", "file", "symlink"}, kind) {
+			kind = "other"
+		}
+		m[file.Path] = manifestEntry{Kind: kind, Size: int64(file.Size)}
+		return nil
+	})
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyManifest compares the live files with m. With extra, files below
+// paths that are not in m are differences too, as after a restore that
+// deletes them. It returns the files compared and the differences.
+func verifyManifest(ctx context.Context, m manifest, paths []string, extra bool) (int, []FileMismatch, error) {
+	var mismatches []FileMismatch
+	files := make([]string, 0, len(m))
+	for file := range m {
+		files = append(files, file)
+	}
+	slices.Sort(files)
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return len(files), mismatches, err
+		}
+		if problem := compareFile(file, m[file]); problem != "" {
+			mismatches = append(mismatches, FileMismatch{Path: file, Problem: problem})
+		}
+	}
+	if extra {
+		for _, path := range paths {
+			err := filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if _, ok := m[file]; !ok {
+					mismatches = append(mismatches, FileMismatch{Path: file, Problem: "not in the snapshot"})
+					if d.IsDir() {
+						return fs.SkipDir
+					}
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return len(files), mismatches, err
+			}
+		}
+	}
+	return len(files), mismatches, nil
+}
+
+// verifyRestore compares the restored files with expected and adds the
+// result to the report. Differences only fail the restore with
+// StrictVerify.
+func verifyRestore(ctx context.Context, report *RestoreReport, expected manifest, opts config.RestoreOptions, extra bool) error {
+	slog.Info("verifying restored files", "paths", report.Paths, "verify", report.Verify)
+	files, mismatches, err := verifyManifest(ctx, expected, report.Paths, extra)
+	report.VerifiedFiles = files
+	report.VerifyMismatches = len(mismatches)
+	report.Mismatches = mismatches[:min(len(mismatches), maxFileMismatches)]
+	if err != nil {
+		if opts.StrictVerify {
+			return fmt.Errorf("%w: %w", providers.ErrVerifyFailed, err)
+		}
+		slog.Warn("cannot verify the restored files", "error", err)
+		return nil
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	slog.Warn("restored files differ from the snapshot", "files", len(mismatches), "first", mismatches[0].Path, "problem", mismatches[0].Problem)
+	if opts.StrictVerify {
+		return fmt.Errorf("%w: %d files, e.g. %s %s", providers.ErrVerifyFailed, len(mismatches), mismatches[0].Path, mismatches[0].Problem)
+	}
+	return nil
+}
+
+// compareFile describes how file differs from expected, empty if it does
+// not.
+func compareFile(file string, expected manifestEntry) string {
+	info, err := os.Lstat(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "missing"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if kind := fileKind(info.Mode()); kind != expected.Kind {
+		return fmt.Sprintf("is a %s, the snapshot has a %s", kind, expected.Kind)
+	}
+	if expected.Kind != "file" {
+		return ""
+	}
+	if info.Size() != expected.Size {
+		return fmt.Sprintf("has %d bytes, the snapshot %d", info.Size(), expected.Size)
+	}
+	if expected.Hash == "" {
+		return ""
+	}
+	hash, err := hashFile(file)
+	if err != nil {
+		return err.Error()
+	}
+	if hash != expected.Hash {
+		return "content differs"
+	}
+	return ""
+}
@@ -0,0 +1,268 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"zxcvmk/cmd/backup"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/output"
+	"zxcvmk/pkg/schedule"
+	"zxcvmk/pkg/state"
+)
+
+// jobOperation is the state.Run operation recording the last run of a job.
+const jobOperation = "job"
+
+type DaemonArguments struct {
+	ShutdownTimeout time.Duration
+	DryRun          bool
+	// Job runs a single job once instead of the schedule, e.g. from a
+	// systemd timer.
+	Job    string
+	Output output.Options
+}
+
+// JobStatus describes a configured job and when it runs.
+type JobStatus struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Schedule string    `json:"schedule"`
+	Jitter   string    `json:"jitter,omitempty" output:"wide"`
+	LastRun  time.Time `json:"lastRun,omitempty" output:"time"`
+	Result   string    `json:"result,omitempty"`
+	NextRun  time.Time `json:"nextRun" output:"time"`
+}
+
+type job struct {
+	config.Job
+	schedule *schedule.Schedule
+	jitter   time.Duration
+	lastRun  *state.Run
+}
+
+type daemon struct {
+	cfg   *config.Config
+	store *state.Store
+	// running admits one job at a time, jobs sharing a repository would
+	// otherwise fight over its lock
+	running chan struct{}
+}
+
+// Run runs the configured jobs on their schedule until ctx is done. A run
+// missed while the daemon was not running is caught up once at startup. On
+// shutdown running jobs get daemonArguments.ShutdownTimeout to finish before
+// they are cancelled.
+func Run(ctx context.Context, cfg *config.Config, daemonArguments DaemonArguments) error {
+	d := &daemon{
+		cfg:     cfg,
+		store:   state.Open(cfg.StateDirectory()),
+		running: make(chan struct{}, 1),
+	}
+	jobs, err := d.jobs()
+	if err != nil {
+		return err
+	}
+	if daemonArguments.DryRun {
+		return output.Print(jobStatuses(jobs, time.Now()), daemonArguments.Output)
+	}
+	if daemonArguments.Job != "" {
+		for _, j := range jobs {
+			if j.Name == daemonArguments.Job {
+				return d.run(ctx, ctx, j)
+			}
+		}
+		return fmt.Errorf("job %q is not configured", daemonArguments.Job)
+	}
+	if len(jobs) == 0 {
+		return errors.New("no jobs configured")
+	}
+	unlock, err := lockDaemon(cfg.StateDirectory())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// jobs keep running after ctx is done until the shutdown timeout
+	jobCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelJobs()
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.loop(ctx, jobCtx, j)
+		}()
+	}
+	slog.Info("daemon started", "jobs", len(jobs))
+
+	<-ctx.Done()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	slog.Info("shutting down, waiting for running jobs", "timeout", daemonArguments.ShutdownTimeout)
+	select {
+	case <-done:
+	case <-time.After(daemonArguments.ShutdownTimeout):
+		slog.Warn("cancelling running jobs")
+		cancelJobs()
+		<-done
+	}
+	return nil
+}
+
+func (d *daemon) jobs() ([]*job, error) {
+	runs, err := d.store.Runs()
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*job
+	for _, cfgJob := range d.cfg.Jobs {
+		j := &job{Job: cfgJob}
+		if j.schedule, err = schedule.Parse(cfgJob.Schedule); err != nil {
+			return nil, fmt.Errorf("job %s: %w", cfgJob.Name, err)
+		}
+		if cfgJob.Jitter != "" {
+			if j.jitter, err = config.ParseDuration(cfgJob.Jitter); err != nil {
+				return nil, fmt.Errorf("job %s: invalid jitter: %w", cfgJob.Name, err)
+			}
+		}
+		for i := range runs {
+			if runs[i].Operation == jobOperation && runs[i].Target == cfgJob.Name {
+				j.lastRun = &runs[i]
+			}
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func jobStatuses(jobs []*job, now time.Time) []*JobStatus {
+	statuses := []*JobStatus{}
+	for _, j := range jobs {
+		status := &JobStatus{
+			Name:     j.Name,
+			Type:     j.Type,
+			Schedule: j.Schedule,
+			Jitter:   j.Jitter,
+			NextRun:  j.schedule.Next(now),
+		}
+		if j.lastRun != nil {
+			status.LastRun = j.lastRun.Started
+			status.Result = "failed"
+			if j.lastRun.Success {
+				status.Result = "ok"
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// loop runs a job on its schedule. A job never overlaps itself: runs that
+// come due while it is still running are skipped.
+func (d *daemon) loop(ctx, jobCtx context.Context, j *job) {
+	if j.lastRun != nil {
+		if missed := j.schedule.Next(j.lastRun.Started); !missed.IsZero() && missed.Before(time.Now()) {
+			slog.Info("catching up missed run", "job", j.Name, "missed", missed)
+			_ = d.run(ctx, jobCtx, j)
+		}
+	}
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			slog.Error("job has no future runs", "job", j.Name, "schedule", j.Schedule)
+			return
+		}
+		var jitter time.Duration
+		if j.jitter > 0 {
+			jitter = rand.N(j.jitter)
+		}
+		slog.Debug("job scheduled", "job", j.Name, "next", next, "jitter", jitter)
+		timer := time.NewTimer(time.Until(next) + jitter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		_ = d.run(ctx, jobCtx, j)
+	}
+}
+
+// run runs a job once and records the result. Failures are logged, the
+// error is only returned for callers running a single job.
+func (d *daemon) run(ctx, jobCtx context.Context, j *job) error {
+	select {
+	case d.running <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-d.running }()
+
+	slog.Info("running job", "job", j.Name, "type", j.Type)
+	started := time.Now()
+	err := runJob(jobCtx, d.cfg, j.Job)
+	run := state.NewRun(jobOperation, j.Name, started, err)
+	if err != nil {
+		slog.Error("job failed", "job", j.Name, "duration", run.Duration.Round(time.Second), "error", err)
+	} else {
+		slog.Info("job finished", "job", j.Name, "duration", run.Duration.Round(time.Second))
+	}
+	if err := d.store.Record(run); err != nil {
+		slog.Warn("could not record job run", "job", j.Name, "error", err)
+	}
+	j.lastRun = &run
+	return err
+}
+
+func runJob(ctx context.Context, cfg *config.Config, j config.Job) error {
+	backupArguments := backup.BackupArguments{
+		Paths:        j.Paths,
+		Repositories: j.Repositories,
+		ReadData:     j.ReadData,
+		Retention:    j.Retention,
+		Output:       output.Options{Format: "json"},
+	}
+	// every job fetches the secrets again
+	ctx = backup.WithRun(ctx, cfg)
+	switch j.Type {
+	case config.JobBackup:
+		return backup.Run(ctx, cfg, backupArguments)
+	case config.JobPrune:
+		return backup.Prune(ctx, cfg, backupArguments)
+	case config.JobCheck:
+		return backup.Check(ctx, cfg, backupArguments)
+	case config.JobDrill:
+		return backup.Drill(ctx, cfg, backupArguments)
+	}
+	return fmt.Errorf("unsupported job type %q", j.Type)
+}
+
+// lockDaemon makes sure only one daemon runs the jobs of a state directory.
+func lockDaemon(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "daemon.lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("another daemon is already running with state directory %s", dir)
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
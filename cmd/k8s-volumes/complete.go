@@ -0,0 +1,78 @@
+package k8svolumes
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The completion functions return the names of the cluster objects, each
+// followed by a tab and a description for the shell.
+
+// CompleteNamespaces lists the namespaces of the cluster.
+func CompleteNamespaces(ctx context.Context) ([]string, error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list namespaces: %w", err)
+	}
+	var names []string
+	for _, ns := range namespaces.Items {
+		names = append(names, ns.Name+"\t"+string(ns.Status.Phase))
+	}
+	return names, nil
+}
+
+// CompletePvcs lists the persistent volume claims in the namespace.
+func CompletePvcs(ctx context.Context, k8sArguments K8sArguments) ([]string, error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	pvcs, err := clientset.CoreV1().PersistentVolumeClaims(k8sArguments.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list pvcs: %w", err)
+	}
+	var names []string
+	for _, pvc := range pvcs.Items {
+		description := string(pvc.Status.Phase)
+		if size, ok := pvc.Spec.Resources.Requests["storage"]; ok {
+			description += " " + size.String()
+		}
+		if pvc.Spec.StorageClassName != nil {
+			description += " " + *pvc.Spec.StorageClassName
+		}
+		names = append(names, pvc.Name+"\t"+description)
+	}
+	return names, nil
+}
+
+// CompleteDeployments lists the deployments in the namespace, only the ones
+// mounting --pvc-src if it is set.
+func CompleteDeployments(ctx context.Context, k8sArguments K8sArguments) ([]string, error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	deployments, err := clientset.AppsV1().Deployments(k8sArguments.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list deployments: %w", err)
+	}
+	var names []string
+	for _, deployment := range deployments.Items {
+		mounts := k8sArguments.PvcSrc == ""
+		for _, volume := range deployment.Spec.Template.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == k8sArguments.PvcSrc {
+				mounts = true
+			}
+		}
+		if mounts {
+			names = append(names, fmt.Sprintf("%s\t%d/%d ready", deployment.Name, deployment.Status.ReadyReplicas, deployment.Status.Replicas))
+		}
+	}
+	return names, nil
+}
@@ -18,6 +18,11 @@ import (
 	"os"
 	"time"
 	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/history"
+	"zxcvmk/pkg/notify"
+	"zxcvmk/pkg/output"
+	"zxcvmk/pkg/secrets"
+	"zxcvmk/pkg/state"
 
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -40,59 +45,91 @@ type K8sArguments struct {
 	DestVolumeSize       string
 	DestStorageClassName string
 	DryRun               bool
+	Output               output.Options
 }
 
-func Replant(cfg *config.Config, k8sArguments K8sArguments) {
+// ReplantResult summarises a completed replant.
+type ReplantResult struct {
+	Namespace      string    `json:"namespace"`
+	Deployment     string    `json:"deployment,omitempty"`
+	SourcePvc      string    `json:"sourcePvc"`
+	DestinationPvc string    `json:"destinationPvc"`
+	Replicas       int32     `json:"replicas,omitempty" output:"wide"`
+	Started        time.Time `json:"started"`
+	Duration       string    `json:"duration"`
+}
+
+func Replant(ctx context.Context, cfg *config.Config, k8sArguments K8sArguments) (_ *ReplantResult, err error) {
 	// todo: add support for KUBECONFIG
 
+	result := &ReplantResult{
+		Namespace:      k8sArguments.Namespace,
+		SourcePvc:      k8sArguments.PvcSrc,
+		DestinationPvc: k8sArguments.PvcDst,
+		Started:        time.Now(),
+	}
+	entry := history.NewEntry("replant", k8sArguments.Namespace+"/"+k8sArguments.PvcSrc)
+	defer func() {
+		recordReplant(ctx, cfg, entry, err)
+	}()
 	clientset, err := getClientSet()
 	if err != nil {
-		slog.Error("cannot get clientset: {err}", "err", err)
-		return
+		return nil, fmt.Errorf("cannot get clientset: %w", err)
 	}
 
+	// compensating steps must still reach the API server after the run was
+	// interrupted, so they use a context that is not cancelled with ctx
+	cleanupCtx := context.WithoutCancel(ctx)
+
 	var deployment *v1.Deployment
+	var originalReplicas int32 = 1
+	replanted := false
 
 	if k8sArguments.Deployment != "" {
-		deployment, err = findPvcUseDeployment(k8sArguments, clientset)
+		deployment, err = findPvcUseDeployment(ctx, k8sArguments, clientset)
 		if err != nil {
-			slog.Error("could not find deployment", "error", err)
-			return
+			return nil, fmt.Errorf("could not find deployment: %w", err)
 		}
 		if deployment == nil {
 			slog.Info("could not find deployment, will only migrate volume")
 		} else {
 			slog.Info("Deployment found", "deployment", deployment.Name, "spec", deployment.Spec)
+			if deployment.Spec.Replicas != nil {
+				originalReplicas = *deployment.Spec.Replicas
+			}
 
-			deployment, err = scaleDownDeployment(k8sArguments, deployment, clientset)
+			deployment, err = scaleDownDeployment(ctx, k8sArguments, deployment, clientset)
 			if err != nil {
-				slog.Error("could scale down deployment", "error", err)
-				return
+				return nil, fmt.Errorf("could scale down deployment: %w", err)
 			}
+			defer func() {
+				if !replanted {
+					scaleDeployment(cleanupCtx, k8sArguments, deployment.Name, originalReplicas, clientset)
+				}
+			}()
 		}
 	}
 	slog.Info("creating temporary pod")
-	pod, err := createTemporaryPod(k8sArguments, clientset)
-	time.Sleep(3 * time.Second)
+	pod, err := createTemporaryPod(ctx, k8sArguments, clientset)
 	if err != nil {
-		slog.Error("could not create pod", "error", err)
-		return
+		return nil, fmt.Errorf("could not create pod: %w", err)
+	}
+	defer cleanupPod(cleanupCtx, k8sArguments, pod.Name, clientset)
+	if err = sleep(ctx, 3*time.Second); err != nil {
+		return nil, fmt.Errorf("replant interrupted: %w", err)
 	}
-	defer cleanupPod(k8sArguments, pod.Name, clientset)
 
-	pvc, err := createTargetPvc(k8sArguments, clientset)
+	pvc, err := createTargetPvc(ctx, k8sArguments, clientset)
 	if err != nil {
-		slog.Error("could not create pvc", "error", err)
-		return
+		return nil, fmt.Errorf("could not create pvc: %w", err)
 	}
 	// defer cleanupPvc(k8sArguments, pvc.Name, clientset)
 
-	phase, err := getPodStatusPhase(clientset, pod)
+	phase, err := getPodStatusPhase(ctx, clientset, pod)
 	slog.Debug("pod status phase retrieved", "phase", phase)
 	if err != nil {
-		slog.Error("cannot get pod status, timeout")
-		cleanupPvc(k8sArguments, pvc.Name, clientset)
-		return
+		cleanupPvc(cleanupCtx, k8sArguments, pvc.Name, clientset)
+		return nil, fmt.Errorf("cannot get pod status: %w", err)
 	}
 	if phase == corev1.PodRunning {
 		slog.Debug("pod status is Running. continue.")
@@ -101,26 +138,61 @@ func Replant(cfg *config.Config, k8sArguments K8sArguments) {
 	slog.Info("pod created", "pod", pod.Name, "mounts", pod.Spec.Containers[0].VolumeMounts)
 	slog.Info("pvc created", "pvc", pvc.Name, "mounts", pvc.Spec.VolumeName)
 
-	err = transferVolumeContents(clientset, pod)
+	err = transferVolumeContents(ctx, clientset, pod)
 	if err != nil {
-		slog.Error("cannot transfer volume contents", "error", err)
-		cleanupPvc(k8sArguments, pvc.Name, clientset)
-		return
+		cleanupPvc(cleanupCtx, k8sArguments, pvc.Name, clientset)
+		return nil, fmt.Errorf("cannot transfer volume contents: %w", err)
 	}
 	if deployment != nil {
-		_, err = mountNewVolumesOnDeployment(k8sArguments, deployment, pvc, clientset)
+		_, err = mountNewVolumesOnDeployment(ctx, k8sArguments, deployment, pvc, originalReplicas, clientset)
 		if err != nil {
-			slog.Error("cannot restore deployment to previous state with the new volume", "error", err)
-			cleanupPvc(k8sArguments, pvc.Name, clientset)
-			return
+			cleanupPvc(cleanupCtx, k8sArguments, pvc.Name, clientset)
+			return nil, fmt.Errorf("cannot restore deployment to previous state with the new volume: %w", err)
 		}
+		replanted = true
+		result.Deployment = deployment.Name
+		result.Replicas = originalReplicas
 	}
 	slog.Info("transfer complete")
+	result.Duration = time.Since(result.Started).Round(time.Second).String()
+	return result, nil
+}
+
+// recordReplant stores the outcome of a replant in the history and for
+// `serve metrics`, and notifies about it. All of it is best effort.
+func recordReplant(ctx context.Context, cfg *config.Config, entry *history.Entry, err error) {
+	entry.Finish(err)
+	if recordErr := history.Open(cfg.StateDirectory()).Add(entry); recordErr != nil {
+		slog.Warn("could not record history", "operation", "replant", "error", recordErr)
+	}
+	target := entry.Targets[0]
+	run := state.NewRun("replant", target, entry.Started, err)
+	if recordErr := state.Open(cfg.StateDirectory()).Record(run); recordErr != nil {
+		slog.Warn("could not record run", "operation", "replant", "error", recordErr)
+	}
+	ctx = context.WithoutCancel(ctx)
+	dispatcher, notifyErr := notify.New(ctx, cfg, secrets.NewResolver(cfg.AgeKeyFile))
+	if notifyErr == nil {
+		notifyErr = dispatcher.Emit(ctx, notify.OperationEvent("replant", target, entry.Duration, err))
+	}
+	if notifyErr != nil {
+		slog.Warn("could not send notification", "event", "replant", "error", notifyErr)
+	}
 }
 
-func getPodStatusPhase(clientset *kubernetes.Clientset, pod *corev1.Pod) (corev1.PodPhase, error) {
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func getPodStatusPhase(ctx context.Context, clientset *kubernetes.Clientset, pod *corev1.Pod) (corev1.PodPhase, error) {
 	for attempts := 0; attempts < 20; attempts++ {
-		podStatus, err := clientset.CoreV1().Pods(pod.ObjectMeta.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+		podStatus, err := clientset.CoreV1().Pods(pod.ObjectMeta.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
 		if err != nil {
 			return "", fmt.Errorf("cannot get pod status phase: %w", err)
 		}
@@ -129,13 +201,15 @@ func getPodStatusPhase(clientset *kubernetes.Clientset, pod *corev1.Pod) (corev1
 			return podStatus.Status.Phase, nil
 		}
 
-		time.Sleep(5 * time.Second)
+		if err = sleep(ctx, 5*time.Second); err != nil {
+			return "", fmt.Errorf("cannot get pod status phase: %w", err)
+		}
 	}
 
 	return "", fmt.Errorf("pod did not reach Running state within expected time")
 }
 
-func runCmdOnAPod(clientset *kubernetes.Clientset, pod *corev1.Pod, command []string) error {
+func runCmdOnAPod(ctx context.Context, clientset *kubernetes.Clientset, pod *corev1.Pod, command []string) error {
 	kubeCfg := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 		clientcmd.NewDefaultClientConfigLoadingRules(),
 		&clientcmd.ConfigOverrides{},
@@ -165,7 +239,7 @@ func runCmdOnAPod(clientset *kubernetes.Clientset, pod *corev1.Pod, command []st
 	}
 
 	var stdout, stderr bytes.Buffer
-	err = exec.StreamWithContext(context.TODO(), remotecommand.StreamOptions{
+	err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{
 		Stdout: &stdout,
 		Stderr: &stderr,
 		Stdin:  nil,
@@ -179,20 +253,24 @@ func runCmdOnAPod(clientset *kubernetes.Clientset, pod *corev1.Pod, command []st
 	return nil
 }
 
-func transferVolumeContents(clientset *kubernetes.Clientset, pod *corev1.Pod) error {
-	err := runCmdOnAPod(clientset, pod, []string{"apk", "add", "--no-cache", "rsync"})
+func transferVolumeContents(ctx context.Context, clientset *kubernetes.Clientset, pod *corev1.Pod) error {
+	err := runCmdOnAPod(ctx, clientset, pod, []string{"apk", "add", "--no-cache", "rsync"})
 	if err != nil {
 		return err
 	}
-	return runCmdOnAPod(clientset, pod, []string{"rsync", "-a", "--progress", "/source/", "/destination"})
+	return runCmdOnAPod(ctx, clientset, pod, []string{"rsync", "-a", "--progress", "/source/", "/destination"})
 }
 
-func cleanupPod(args K8sArguments, podName string, clientset *kubernetes.Clientset) {
-	clientset.CoreV1().Pods(args.Namespace).Delete(context.TODO(), podName, metav1.DeleteOptions{})
+func cleanupPod(ctx context.Context, args K8sArguments, podName string, clientset *kubernetes.Clientset) {
+	slog.Info("deleting temporary pod", "pod", podName, "namespace", args.Namespace)
+	err := clientset.CoreV1().Pods(args.Namespace).Delete(ctx, podName, metav1.DeleteOptions{})
+	if err != nil {
+		slog.Error("cannot delete temporary pod", "pod", podName, "error", err)
+	}
 }
 
-func cleanupPvc(args K8sArguments, pvcName string, clientset *kubernetes.Clientset) {
-	clientset.CoreV1().PersistentVolumeClaims(args.Namespace).Delete(context.TODO(), pvcName, metav1.DeleteOptions{})
+func cleanupPvc(ctx context.Context, args K8sArguments, pvcName string, clientset *kubernetes.Clientset) {
+	clientset.CoreV1().PersistentVolumeClaims(args.Namespace).Delete(ctx, pvcName, metav1.DeleteOptions{})
 }
 
 func getClientSet() (*kubernetes.Clientset, error) {
@@ -213,9 +291,9 @@ func getClientSet() (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
-func findPvcUseDeployment(k8sArgs K8sArguments, clientset *kubernetes.Clientset) (*v1.Deployment, error) {
+func findPvcUseDeployment(ctx context.Context, k8sArgs K8sArguments, clientset *kubernetes.Clientset) (*v1.Deployment, error) {
 	slog.Info("Namespace", "ns", k8sArgs.Namespace)
-	deployments, err := clientset.AppsV1().Deployments(k8sArgs.Namespace).List(context.TODO(), metav1.ListOptions{})
+	deployments, err := clientset.AppsV1().Deployments(k8sArgs.Namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("cannot get deployment %s: %w", k8sArgs.PvcSrc, err)
 	}
@@ -229,19 +307,35 @@ func findPvcUseDeployment(k8sArgs K8sArguments, clientset *kubernetes.Clientset)
 	return nil, nil
 }
 
-func scaleDownDeployment(k8sArgs K8sArguments, d *v1.Deployment, clientset *kubernetes.Clientset) (*v1.Deployment, error) {
+func scaleDownDeployment(ctx context.Context, k8sArgs K8sArguments, d *v1.Deployment, clientset *kubernetes.Clientset) (*v1.Deployment, error) {
 	newReplicasCount := int32(0)
 	d.Spec.Replicas = &newReplicasCount
 	slog.Info("scaling deployment to 0", "deployment", d.Name, "namespace", d.Namespace)
-	d, err := clientset.AppsV1().Deployments(k8sArgs.Namespace).Update(context.TODO(), d, metav1.UpdateOptions{})
+	d, err := clientset.AppsV1().Deployments(k8sArgs.Namespace).Update(ctx, d, metav1.UpdateOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("cannot scale down deployment: %w", err)
 	}
 	return d, nil
 }
 
-func mountNewVolumesOnDeployment(k8sArgs K8sArguments, d *v1.Deployment, pvc *corev1.PersistentVolumeClaim, clientset *kubernetes.Clientset) (*v1.Deployment, error) {
-	d, err := clientset.AppsV1().Deployments(k8sArgs.Namespace).Get(context.TODO(), d.Name, metav1.GetOptions{})
+// scaleDeployment scales the deployment back to the given replica count. It is
+// used to undo scaleDownDeployment when a replant does not complete.
+func scaleDeployment(ctx context.Context, k8sArgs K8sArguments, name string, replicas int32, clientset *kubernetes.Clientset) {
+	slog.Info("scaling deployment back up", "deployment", name, "namespace", k8sArgs.Namespace, "replicas", replicas)
+	d, err := clientset.AppsV1().Deployments(k8sArgs.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		slog.Error("cannot get deployment to scale back up", "deployment", name, "error", err)
+		return
+	}
+	d.Spec.Replicas = &replicas
+	_, err = clientset.AppsV1().Deployments(k8sArgs.Namespace).Update(ctx, d, metav1.UpdateOptions{})
+	if err != nil {
+		slog.Error("cannot scale deployment back up", "deployment", name, "error", err)
+	}
+}
+
+func mountNewVolumesOnDeployment(ctx context.Context, k8sArgs K8sArguments, d *v1.Deployment, pvc *corev1.PersistentVolumeClaim, replicas int32, clientset *kubernetes.Clientset) (*v1.Deployment, error) {
+	d, err := clientset.AppsV1().Deployments(k8sArgs.Namespace).Get(ctx, d.Name, metav1.GetOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("cannot get deployment: %w", err)
 	}
@@ -261,17 +355,16 @@ func mountNewVolumesOnDeployment(k8sArgs K8sArguments, d *v1.Deployment, pvc *co
 		return nil, fmt.Errorf("cannot update deployment, volume not found: %s", pvc.Name)
 	}
 
-	newReplicasCount := int32(1)
-	d.Spec.Replicas = &newReplicasCount
-	slog.Info("scaling deployment to 0", "deployment", d.Name, "namespace", d.Namespace)
-	d, err = clientset.AppsV1().Deployments(k8sArgs.Namespace).Update(context.TODO(), d, metav1.UpdateOptions{})
+	d.Spec.Replicas = &replicas
+	slog.Info("scaling deployment up", "deployment", d.Name, "namespace", d.Namespace, "replicas", replicas)
+	d, err = clientset.AppsV1().Deployments(k8sArgs.Namespace).Update(ctx, d, metav1.UpdateOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("cannot update deployment, update failed: %w", err)
 	}
 	return d, nil
 }
 
-func createTargetPvc(k8sArgs K8sArguments, clientset *kubernetes.Clientset) (*corev1.PersistentVolumeClaim, error) {
+func createTargetPvc(ctx context.Context, k8sArgs K8sArguments, clientset *kubernetes.Clientset) (*corev1.PersistentVolumeClaim, error) {
 	storageclassname := k8sArgs.DestStorageClassName
 	storageQuantity := resource.MustParse(k8sArgs.DestVolumeSize)
 
@@ -295,7 +388,7 @@ func createTargetPvc(k8sArgs K8sArguments, clientset *kubernetes.Clientset) (*co
 		},
 	}
 
-	pvccr, err := clientset.CoreV1().PersistentVolumeClaims(k8sArgs.Namespace).Create(context.TODO(), &newpvc, metav1.CreateOptions{})
+	pvccr, err := clientset.CoreV1().PersistentVolumeClaims(k8sArgs.Namespace).Create(ctx, &newpvc, metav1.CreateOptions{})
 	slog.Info("created new pvc", "pvc", "spec", pvccr.Name, pvccr.Spec)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create target pvc: %w", err)
@@ -303,7 +396,7 @@ func createTargetPvc(k8sArgs K8sArguments, clientset *kubernetes.Clientset) (*co
 	return pvccr, nil
 }
 
-func createTemporaryPod(k8sArgs K8sArguments, clientset *kubernetes.Clientset) (*corev1.Pod, error) {
+func createTemporaryPod(ctx context.Context, k8sArgs K8sArguments, clientset *kubernetes.Clientset) (*corev1.Pod, error) {
 	tempPod := corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "temppod",
@@ -347,7 +440,7 @@ func createTemporaryPod(k8sArgs K8sArguments, clientset *kubernetes.Clientset) (
 			},
 		},
 	}
-	newpod, err := clientset.CoreV1().Pods(k8sArgs.Namespace).Create(context.TODO(), &tempPod, metav1.CreateOptions{})
+	newpod, err := clientset.CoreV1().Pods(k8sArgs.Namespace).Create(ctx, &tempPod, metav1.CreateOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("cannot create pod: %w", err)
 	}
@@ -0,0 +1,572 @@
+package serve
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"zxcvmk/cmd/backup"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/providers"
+	"zxcvmk/pkg/secrets"
+)
+
+type APIArguments struct {
+	Listen string
+	// Token is a secret reference to the bearer token.
+	Token string
+	// BasicAuth holds user:secret-reference pairs.
+	BasicAuth []string
+	ReadOnly  bool
+	NoAuth    bool
+	// ShutdownTimeout is how long running restores may take to finish,
+	// with their post-restore hooks, once the server is stopped.
+	ShutdownTimeout time.Duration
+}
+
+//go:embed ui
+var ui embed.FS
+
+// API serves the REST API and the web UI to browse snapshots, download files
+// and trigger restores.
+func API(ctx context.Context, cfg *config.Config, backupArguments backup.BackupArguments, apiArguments APIArguments) error {
+	auth, err := newAuthenticator(ctx, cfg, apiArguments)
+	if err != nil {
+		return err
+	}
+	if len(backupArguments.Repositories) == 0 {
+		backupArguments.Repositories = []string{"all"}
+	}
+	s := &server{
+		ctx:             ctx,
+		cfg:             cfg,
+		backupArguments: backupArguments,
+		readOnly:        apiArguments.ReadOnly,
+		confirmations:   map[string]pendingRestore{},
+	}
+	static, err := fs.Sub(ui, "ui")
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/info", s.info)
+	mux.HandleFunc("GET /api/targets", s.targets)
+	mux.HandleFunc("GET /api/snapshots", s.snapshots)
+	mux.HandleFunc("GET /api/snapshots/{id}/files", s.files)
+	mux.HandleFunc("GET /api/snapshots/{id}/download", s.download)
+	mux.HandleFunc("GET /api/restores", s.restores)
+	mux.HandleFunc("GET /api/restores/{id}", s.restoreStatus)
+	mux.HandleFunc("POST /api/restores", s.restore)
+	mux.Handle("GET /", http.FileServerFS(static))
+	if apiArguments.ReadOnly {
+		slog.Info("read-only mode, restores are disabled")
+	}
+	err = listen(ctx, apiArguments.Listen, auth.wrap(s.withRun(mux)))
+	s.waitRestores(apiArguments.ShutdownTimeout)
+	return err
+}
+
+// waitRestores waits up to timeout for the running restores, they are
+// interrupted with the server but still have to bring the services back up.
+func (s *server) waitRestores(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	default:
+	}
+	slog.Info("waiting for running restores", "timeout", timeout)
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("running restores did not finish in time, their post-restore hooks may not have run")
+	}
+}
+
+// authenticator checks the bearer token or the basic auth credentials of a
+// request. The token is also accepted as basic auth password, so browsers
+// can use it.
+type authenticator struct {
+	token  secrets.Secret
+	users  map[string]secrets.Secret
+	noAuth bool
+}
+
+type userKey struct{}
+
+func newAuthenticator(ctx context.Context, cfg *config.Config, apiArguments APIArguments) (*authenticator, error) {
+	a := &authenticator{users: map[string]secrets.Secret{}, noAuth: apiArguments.NoAuth}
+	if apiArguments.Token == "" && len(apiArguments.BasicAuth) == 0 && !apiArguments.NoAuth {
+		return nil, errors.New("--token or --basic-auth is required, use --no-auth to serve without authentication")
+	}
+	resolver := secrets.NewResolver(cfg.AgeKeyFile)
+	if apiArguments.Token != "" {
+		token, err := resolver.Resolve(ctx, apiArguments.Token)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve --token: %w", err)
+		}
+		a.token = token
+	}
+	for _, pair := range apiArguments.BasicAuth {
+		name, ref, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || ref == "" {
+			return nil, fmt.Errorf("invalid --basic-auth %q, expected user:secret-reference", pair)
+		}
+		password, err := resolver.Resolve(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve password of %s: %w", name, err)
+		}
+		a.users[name] = password
+	}
+	return a, nil
+}
+
+// withRun starts a run for every request, so that secrets are not cached
+// for the lifetime of the server.
+func (s *server) withRun(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(backup.WithRun(r.Context(), s.cfg)))
+	})
+}
+
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := a.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="zxcvmk", charset="UTF-8"`)
+			writeError(w, http.StatusUnauthorized, errors.New("authentication required"))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+func (a *authenticator) authenticate(r *http.Request) (string, bool) {
+	if a.noAuth {
+		return "anonymous", true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return "token", a.checkToken(token)
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	if expected, ok := a.users[name]; ok {
+		return name, equal(password, expected.Value())
+	}
+	return name, a.checkToken(password)
+}
+
+func (a *authenticator) checkToken(token string) bool {
+	return !a.token.IsZero() && equal(token, a.token.Value())
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+type server struct {
+	// ctx outlives the requests, restores keep running after the request
+	// that started them
+	ctx             context.Context
+	cfg             *config.Config
+	backupArguments backup.BackupArguments
+	readOnly        bool
+
+	// running tracks the restore goroutines
+	running sync.WaitGroup
+
+	mu          sync.Mutex
+	restoreJobs []*restoreJob
+	// confirmations are the restores previewed and not yet confirmed, by
+	// confirmation token
+	confirmations map[string]pendingRestore
+}
+
+// confirmationTTL is how long a previewed restore can be confirmed.
+const confirmationTTL = 5 * time.Minute
+
+// pendingRestore is a previewed restore, its confirmation token only
+// confirms the same restore for the same user.
+type pendingRestore struct {
+	Snapshot string
+	Paths    []string
+	User     string
+	Expires  time.Time
+}
+
+// restoreJob is a restore triggered through the API.
+type restoreJob struct {
+	ID       int        `json:"id"`
+	Snapshot string     `json:"snapshot"`
+	Paths    []string   `json:"paths"`
+	User     string     `json:"user"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	// Reports are set once the restore has finished, one per target.
+	Reports []*backup.RestoreReport `json:"reports,omitempty"`
+}
+
+func (s *server) info(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"user":     requestUser(r),
+		"readOnly": s.readOnly,
+	})
+}
+
+type target struct {
+	Location     string   `json:"location"`
+	Repositories []string `json:"repositories"`
+	Hooks        bool     `json:"hooks"`
+}
+
+func (s *server) targets(w http.ResponseWriter, r *http.Request) {
+	targets := []target{}
+	for _, t := range s.cfg.BackupTargets {
+		targets = append(targets, target{
+			Location:     t.Location,
+			Repositories: s.cfg.TargetRepositories(t.Location),
+			Hooks:        t.PreRestoreHook != nil || t.PostRestoreHook != nil,
+		})
+	}
+	writeJSON(w, http.StatusOK, targets)
+}
+
+// arguments returns the backup arguments for a request, limited to the
+// snapshots of the path query parameter if it is set.
+func (s *server) arguments(r *http.Request) (backup.BackupArguments, error) {
+	args := s.backupArguments
+	args.SnapshotID = r.PathValue("id")
+	if r.URL.Query().Get("path") != "" && args.SnapshotID == "" {
+		p := queryPath(r)
+		if err := s.checkTarget(p); err != nil {
+			return args, err
+		}
+		args.Paths = []string{p}
+	}
+	return args, nil
+}
+
+// checkTarget rejects paths outside the backup targets, the API only exposes
+// the files it could restore.
+func (s *server) checkTarget(p string) error {
+	if _, ok := s.cfg.TargetOf(p); !ok {
+		return fmt.Errorf("%s is not inside a backup target", p)
+	}
+	return nil
+}
+
+func (s *server) snapshots(w http.ResponseWriter, r *http.Request) {
+	args, err := s.arguments(r)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	snapshots, err := backup.Snapshots(r.Context(), s.cfg, args)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	if snapshots == nil {
+		snapshots = []*providers.Snapshot{}
+	}
+	slices.SortFunc(snapshots, func(a, b *providers.Snapshot) int {
+		return strings.Compare(b.Time, a.Time)
+	})
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+func (s *server) files(w http.ResponseWriter, r *http.Request) {
+	dir := queryPath(r)
+	args, err := s.arguments(r)
+	if err == nil {
+		err = s.checkTarget(dir)
+	}
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	files, err := backup.ListFiles(r.Context(), s.cfg, args, dir)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	slices.SortFunc(files, func(a, b *providers.File) int {
+		if a.IsDir() != b.IsDir() {
+			if a.IsDir() {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	writeJSON(w, http.StatusOK, files)
+}
+
+func (s *server) download(w http.ResponseWriter, r *http.Request) {
+	file := queryPath(r)
+	args, err := s.arguments(r)
+	if err == nil {
+		err = s.checkTarget(file)
+	}
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	info, err := backup.StatFile(r.Context(), s.cfg, args, file)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	name := path.Base(info.Path)
+	if info.IsDir() {
+		name += ".tar"
+		w.Header().Set("Content-Type", "application/x-tar")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	slog.Info("download", "user", requestUser(r), "snapshot", args.SnapshotID, "path", info.Path)
+	if err := backup.Dump(r.Context(), s.cfg, args, info.Path, w); err != nil {
+		// the headers are gone already, the client sees a truncated body
+		slog.Error("download failed", "snapshot", args.SnapshotID, "path", info.Path, "error", err)
+	}
+}
+
+func (s *server) restores(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := slices.Clone(s.restoreJobs)
+	slices.Reverse(jobs)
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *server) restoreStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.restoreJobs {
+		if fmt.Sprint(job.ID) == r.PathValue("id") {
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("restore %s not found", r.PathValue("id")))
+}
+
+// restoreRequest starts a restore. Without Confirmation the restore is only
+// described, the client has to send it again with the confirmation token of
+// the description.
+type restoreRequest struct {
+	Snapshot     string   `json:"snapshot"`
+	Paths        []string `json:"paths"`
+	Confirmation string   `json:"confirmation"`
+}
+
+// checkSameOrigin rejects requests a browser sends on behalf of another
+// site, which would carry cached basic auth credentials. A cross-site form
+// cannot send JSON, browsers mark cross-site requests with Sec-Fetch-Site and
+// Origin.
+func checkSameOrigin(r *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return errors.New("the request must be sent as application/json")
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		return fmt.Errorf("cross-site request (%s) rejected", site)
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return fmt.Errorf("request from origin %s rejected", origin)
+		}
+	}
+	return nil
+}
+
+func newConfirmationToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// confirm consumes the confirmation token of a previewed restore, it has to
+// match the request.
+func (s *server) confirm(req restoreRequest, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for token, pending := range s.confirmations {
+		if now.After(pending.Expires) {
+			delete(s.confirmations, token)
+		}
+	}
+	pending, ok := s.confirmations[req.Confirmation]
+	if !ok {
+		return errors.New("unknown or expired confirmation, preview the restore again")
+	}
+	delete(s.confirmations, req.Confirmation)
+	if pending.User != user || pending.Snapshot != req.Snapshot || !slices.Equal(pending.Paths, req.Paths) {
+		return errors.New("the confirmation is for a different restore")
+	}
+	return nil
+}
+
+func (s *server) restore(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly {
+		writeError(w, http.StatusForbidden, errors.New("restores are disabled in read-only mode"))
+		return
+	}
+	if err := checkSameOrigin(r); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	var req restoreRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	if req.Snapshot == "" || len(req.Paths) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("snapshot and paths are required"))
+		return
+	}
+	var hooks []string
+	for _, p := range req.Paths {
+		t, ok := s.cfg.Target(p)
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s is not a backup target", p))
+			return
+		}
+		for _, hook := range [][]string{t.PreRestoreHook, t.PostRestoreHook} {
+			if hook != nil {
+				hooks = append(hooks, strings.Join(hook, " "))
+			}
+		}
+	}
+	if req.Confirmation == "" {
+		token, err := newConfirmationToken()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.mu.Lock()
+		s.confirmations[token] = pendingRestore{
+			Snapshot: req.Snapshot,
+			Paths:    req.Paths,
+			User:     requestUser(r),
+			Expires:  time.Now().Add(confirmationTTL),
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusPreconditionRequired, map[string]any{
+			"snapshot":     req.Snapshot,
+			"paths":        req.Paths,
+			"hooks":        hooks,
+			"confirmation": token,
+			"message":      fmt.Sprintf("restoring replaces the contents of %s with snapshot %s, send the request again with the confirmation within %s", strings.Join(req.Paths, ", "), req.Snapshot, confirmationTTL),
+		})
+		return
+	}
+	if err := s.confirm(req, requestUser(r)); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	s.mu.Lock()
+	for _, job := range s.restoreJobs {
+		if job.State == "running" {
+			s.mu.Unlock()
+			writeError(w, http.StatusConflict, fmt.Errorf("restore %d is still running", job.ID))
+			return
+		}
+	}
+	job := &restoreJob{
+		ID:       len(s.restoreJobs) + 1,
+		Snapshot: req.Snapshot,
+		Paths:    req.Paths,
+		User:     requestUser(r),
+		Started:  time.Now(),
+		State:    "running",
+	}
+	s.restoreJobs = append(s.restoreJobs, job)
+	accepted := *job
+	s.mu.Unlock()
+
+	args := s.backupArguments
+	args.SnapshotID = req.Snapshot
+	args.Paths = req.Paths
+	args.RemoteUser = job.User
+	slog.Info("restore requested", "user", job.User, "remote", r.RemoteAddr, "snapshot", req.Snapshot, "paths", req.Paths)
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		reports, err := backup.RestorePaths(backup.WithRun(s.ctx, s.cfg), s.cfg, args)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		finished := time.Now()
+		job.Finished = &finished
+		job.Reports = reports
+		job.State = "succeeded"
+		if err != nil {
+			job.State = "failed"
+			job.Error = err.Error()
+			slog.Error("restore failed", "id", job.ID, "error", err)
+		}
+	}()
+	writeJSON(w, http.StatusAccepted, accepted)
+}
+
+// queryPath returns the absolute, cleaned path query parameter.
+func queryPath(r *http.Request) string {
+	return path.Clean("/" + r.URL.Query().Get("path"))
+}
+
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, providers.ErrSnapshotNotFound), errors.Is(err, providers.ErrTargetMissing):
+		return http.StatusNotFound
+	case errors.Is(err, providers.ErrRepoLocked):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("could not write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
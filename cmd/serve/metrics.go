@@ -0,0 +1,121 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"zxcvmk/cmd/backup"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/metrics"
+	"zxcvmk/pkg/state"
+)
+
+type ServeArguments struct {
+	Listen   string
+	Interval time.Duration
+	Textfile string
+}
+
+// Metrics exports the backup gauges and the outcome of the last runs. With
+// serveArguments.Textfile set it writes them once for the node_exporter
+// textfile collector, otherwise it serves them on /metrics and refreshes
+// them every serveArguments.Interval.
+func Metrics(ctx context.Context, cfg *config.Config, backupArguments backup.BackupArguments, serveArguments ServeArguments) error {
+	if serveArguments.Textfile != "" {
+		set := collect(ctx, cfg, backupArguments)
+		if err := set.WriteFile(serveArguments.Textfile); err != nil {
+			return err
+		}
+		slog.Info("metrics written", "file", serveArguments.Textfile)
+		return nil
+	}
+
+	exporter := &exporter{}
+	exporter.refresh(ctx, cfg, backupArguments)
+	go func() {
+		ticker := time.NewTicker(serveArguments.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				exporter.refresh(ctx, cfg, backupArguments)
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", exporter)
+	return listen(ctx, serveArguments.Listen, mux)
+}
+
+// listen serves handler on addr until ctx is done.
+func listen(ctx context.Context, addr string, handler http.Handler) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("listening", "address", addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// exporter serves the metrics of the last refresh, collecting them takes too
+// long to do it on every scrape.
+type exporter struct {
+	mu      sync.RWMutex
+	metrics []byte
+}
+
+func (e *exporter) refresh(ctx context.Context, cfg *config.Config, backupArguments backup.BackupArguments) {
+	var buf bytes.Buffer
+	if _, err := collect(ctx, cfg, backupArguments).WriteTo(&buf); err != nil {
+		slog.Error("could not render metrics", "error", err)
+		return
+	}
+	e.mu.Lock()
+	e.metrics = buf.Bytes()
+	e.mu.Unlock()
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(e.metrics)
+}
+
+func collect(ctx context.Context, cfg *config.Config, backupArguments backup.BackupArguments) *metrics.Set {
+	started := time.Now()
+	set := metrics.NewSet()
+	backup.CollectMetrics(backup.WithRun(ctx, cfg), cfg, backupArguments, set)
+
+	runs, err := state.Open(cfg.StateDirectory()).Runs()
+	if err != nil {
+		slog.Warn("could not read last runs", "error", err)
+	}
+	for _, run := range runs {
+		labels := []string{"operation", run.Operation, "target", run.Target}
+		set.Gauge("zxcvmk_last_run_timestamp_seconds", "Start time of the last run of each operation and target.", float64(run.Started.Unix()), labels...)
+		set.Gauge("zxcvmk_last_run_duration_seconds", "Duration of the last run of each operation and target.", run.Duration.Seconds(), labels...)
+		set.Gauge("zxcvmk_last_run_success", "Whether the last run of each operation and target succeeded.", metrics.Bool(run.Success), labels...)
+	}
+
+	set.Gauge("zxcvmk_collect_duration_seconds", "Time it took to collect the metrics.", time.Since(started).Seconds())
+	set.Gauge("zxcvmk_collect_timestamp_seconds", "Time the metrics were collected.", float64(started.Unix()))
+	return set
+}
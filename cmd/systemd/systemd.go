@@ -0,0 +1,240 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/schedule"
+)
+
+// systemUnitDir is where --install puts the units.
+const systemUnitDir = "/etc/systemd/system"
+
+type SystemdArguments struct {
+	Dir       string
+	Install   bool
+	Prefix    string
+	OnFailure []string
+}
+
+type unit struct {
+	Name    string
+	Content string
+}
+
+var serviceTemplate = template.Must(template.New("service").Parse(`# generated by zxcvmk systemd generate
+[Unit]
+Description=zxcvmk {{.Job.Type}} job {{.Job.Name}}
+Wants=network-online.target
+After=network-online.target
+{{- range .OnFailure}}
+OnFailure={{.}}
+{{- end}}
+
+[Service]
+Type=oneshot
+ExecStart={{.ExecStart}}
+Nice=10
+IOSchedulingClass=idle
+CacheDirectory=zxcvmk
+Environment=RESTIC_CACHE_DIR=%C/zxcvmk
+ProtectSystem=strict
+{{- range .ReadWritePaths}}
+ReadWritePaths={{.}}
+{{- end}}
+PrivateTmp=true
+NoNewPrivileges=true
+ProtectKernelTunables=true
+ProtectKernelModules=true
+ProtectControlGroups=true
+RestrictSUIDSGID=true
+LockPersonality=true
+`))
+
+var timerTemplate = template.Must(template.New("timer").Parse(`# generated by zxcvmk systemd generate
+[Unit]
+Description=Schedule of the zxcvmk job {{.Job.Name}} ({{.Job.Schedule}})
+
+[Timer]
+{{- range .OnCalendar}}
+OnCalendar={{.}}
+{{- end}}
+{{- if .RandomizedDelaySec}}
+RandomizedDelaySec={{.RandomizedDelaySec}}
+{{- end}}
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`))
+
+// Generate creates a service and a timer unit for every configured job. The
+// services run the job once with `zxcvmk daemon --run`. Without --install or
+// --dir the units are printed.
+func Generate(ctx context.Context, cfg *config.Config, configFile string, systemdArguments SystemdArguments) error {
+	if len(cfg.Jobs) == 0 {
+		return fmt.Errorf("no jobs configured")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot find the zxcvmk executable: %w", err)
+	}
+	configFile, err = filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+
+	var units []unit
+	var timers []string
+	for _, job := range cfg.Jobs {
+		jobUnits, err := jobUnits(cfg, job, executable, configFile, systemdArguments)
+		if err != nil {
+			return fmt.Errorf("job %s: %w", job.Name, err)
+		}
+		units = append(units, jobUnits...)
+		timers = append(timers, jobUnits[1].Name)
+	}
+
+	dir := systemdArguments.Dir
+	if systemdArguments.Install && dir == "" {
+		dir = systemUnitDir
+	}
+	if dir == "" {
+		for _, u := range units {
+			fmt.Printf("# %s\n%s\n", u.Name, u.Content)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, u := range units {
+		if err := os.WriteFile(filepath.Join(dir, u.Name), []byte(u.Content), 0o644); err != nil {
+			return err
+		}
+		slog.Info("unit written", "unit", filepath.Join(dir, u.Name))
+	}
+	if !systemdArguments.Install {
+		return nil
+	}
+	if err := systemctl(ctx, "daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl(ctx, append([]string{"enable", "--now"}, timers...)...)
+}
+
+func jobUnits(cfg *config.Config, job config.Job, executable, configFile string, systemdArguments SystemdArguments) ([]unit, error) {
+	sched, err := schedule.Parse(job.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	var delay int64
+	if job.Jitter != "" {
+		jitter, err := config.ParseDuration(job.Jitter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jitter: %w", err)
+		}
+		delay = int64(jitter.Seconds())
+	}
+	data := struct {
+		Job                config.Job
+		ExecStart          string
+		ReadWritePaths     []string
+		OnFailure          []string
+		OnCalendar         []string
+		RandomizedDelaySec int64
+	}{
+		Job:                job,
+		ExecStart:          quoteCommand(executable, "--config", configFile, "daemon", "--run", job.Name),
+		ReadWritePaths:     readWritePaths(cfg, job),
+		OnFailure:          systemdArguments.OnFailure,
+		OnCalendar:         sched.OnCalendar(),
+		RandomizedDelaySec: delay,
+	}
+
+	name := systemdArguments.Prefix + unitName(job.Name)
+	var service, timer strings.Builder
+	if err := serviceTemplate.Execute(&service, data); err != nil {
+		return nil, err
+	}
+	if err := timerTemplate.Execute(&timer, data); err != nil {
+		return nil, err
+	}
+	return []unit{
+		{Name: name + ".service", Content: service.String()},
+		{Name: name + ".timer", Content: timer.String()},
+	}, nil
+}
+
+// readWritePaths returns the paths a job may write to: the backup targets,
+// their staging directories, the state directory and local repositories. The
+// "-" prefix ignores paths that do not exist.
+func readWritePaths(cfg *config.Config, job config.Job) []string {
+	var paths []string
+	for _, target := range cfg.BackupTargets {
+		if len(job.Paths) == 0 || slices.Contains(job.Paths, target.Location) {
+			paths = append(paths, target.Location)
+			if target.StagingDir != "" {
+				paths = append(paths, target.StagingDir)
+			}
+		}
+	}
+	if cfg.StagingDir != "" {
+		paths = append(paths, cfg.StagingDir)
+	}
+	paths = append(paths, cfg.StateDirectory())
+	for _, provider := range cfg.BackupProviders {
+		repo := strings.TrimPrefix(provider.BackupRepository, "local:")
+		if filepath.IsAbs(repo) {
+			paths = append(paths, repo)
+		}
+	}
+	var quoted []string
+	for _, path := range paths {
+		if path := quote("-" + path); !slices.Contains(quoted, path) {
+			quoted = append(quoted, path)
+		}
+	}
+	return quoted
+}
+
+var unitNameRe = regexp.MustCompile(`[^A-Za-z0-9:_.\-]`)
+
+func unitName(name string) string {
+	return unitNameRe.ReplaceAllString(name, "-")
+}
+
+func quoteCommand(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// quote quotes a word for a unit file when it contains whitespace or
+// characters systemd would interpret.
+func quote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if !strings.ContainsAny(s, " \t\"'\\;$") {
+		return s
+	}
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$").Replace(s)
+	return `"` + s + `"`
+}
+
+func systemctl(ctx context.Context, args ...string) error {
+	output, err := exec.CommandContext(ctx, "systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"zxcvmk/cmd/backup"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/providers"
+
+	"github.com/spf13/cobra"
+)
+
+// completionTTL is how long completions are reused. Listing snapshots or
+// cluster objects takes seconds, too long to repeat on every tab press.
+const completionTTL = 30 * time.Second
+
+// cachedCompletion returns the completions of list, reusing the ones cached
+// under key if they are recent enough. Errors are only shown with
+// BASH_COMP_DEBUG_FILE set, a failing lookup just completes nothing.
+func cachedCompletion(key []string, list func() ([]string, error)) ([]string, cobra.ShellCompDirective) {
+	file := completionCacheFile(key)
+	if file != "" {
+		if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) < completionTTL {
+			var values []string
+			if data, err := os.ReadFile(file); err == nil && json.Unmarshal(data, &values) == nil {
+				return values, cobra.ShellCompDirectiveNoFileComp
+			}
+		}
+	}
+	values, err := list()
+	if err != nil {
+		cobra.CompDebugln(err.Error(), false)
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	if file != "" {
+		if err := writeCompletionCache(file, values); err != nil {
+			cobra.CompDebugln(err.Error(), false)
+		}
+	}
+	return values, cobra.ShellCompDirectiveNoFileComp
+}
+
+func completionCacheFile(key []string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(key, "\x00")))
+	return filepath.Join(dir, "zxcvmk", "completion", hex.EncodeToString(sum[:12])+".json")
+}
+
+func writeCompletionCache(file string, values []string) error {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func completionContext(cmd *cobra.Command) context.Context {
+	if ctx := cmd.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+// snapshotCompletions lists the snapshot IDs with their time, host and
+// paths as description, newest first.
+func snapshotCompletions(ctx context.Context, cfg *config.Config, backupArguments backup.BackupArguments) ([]string, error) {
+	snapshots, err := backup.Snapshots(ctx, cfg, backupArguments)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(snapshots, func(a, b *providers.Snapshot) int {
+		return strings.Compare(b.Time, a.Time)
+	})
+	values := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		when := snapshot.Time
+		if t, err := snapshot.Timestamp(); err == nil {
+			when = t.Local().Format("2006-01-02 15:04")
+		}
+		values = append(values, snapshot.ID+"\t"+when+" "+snapshot.Hostname+" "+strings.Join(snapshot.Paths, ","))
+	}
+	return values, nil
+}
+
+func targetCompletions(cfg *config.Config) []string {
+	var values []string
+	for _, target := range cfg.BackupTargets {
+		values = append(values, target.Location+"\t"+strings.Join(cfg.TargetRepositories(target.Location), ", "))
+	}
+	return values
+}
+
+func repositoryCompletions(cfg *config.Config, all bool) []string {
+	var values []string
+	for _, provider := range cfg.BackupProviders {
+		values = append(values, provider.Name+"\t"+provider.BackupRepository)
+	}
+	if all {
+		values = append(values, "all\tevery configured repository")
+	}
+	return values
+}
+
+func jobCompletions(cfg *config.Config) []string {
+	var values []string
+	for _, job := range cfg.Jobs {
+		values = append(values, job.Name+"\t"+string(job.Type)+" "+job.Schedule)
+	}
+	return values
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"zxcvmk/pkg/providers"
+
+	"github.com/spf13/cobra"
+)
+
+// Process exit codes. They are part of the interface for cron wrappers and
+// alerting, do not renumber them.
+const (
+	exitOK               = 0
+	exitFailure          = 1 // unclassified error
+	exitUsage            = 2 // invalid flags or arguments
+	exitSnapshotNotFound = 3
+	exitRepoLocked       = 4
+	exitAuth             = 5
+	exitHookFailed       = 6
+	exitTargetMissing    = 7
+	exitRepoNotFound     = 8
+	exitConfig           = 9
+	exitVerifyFailed     = 10
+	exitInterrupted      = 130
+)
+
+var errorExitCodes = []struct {
+	err  error
+	code int
+}{
+	// interrupted goes first, a cancelled run usually fails in several ways
+	{providers.ErrInterrupted, exitInterrupted},
+	{providers.ErrHookFailed, exitHookFailed},
+	{providers.ErrSnapshotNotFound, exitSnapshotNotFound},
+	{providers.ErrRepoLocked, exitRepoLocked},
+	{providers.ErrAuth, exitAuth},
+	{providers.ErrTargetMissing, exitTargetMissing},
+	{providers.ErrRepoNotFound, exitRepoNotFound},
+	{providers.ErrVerifyFailed, exitVerifyFailed},
+	{errUsage, exitUsage},
+	{errConfig, exitConfig},
+}
+
+// errConfig marks errors caused by a missing or invalid configuration.
+var errConfig = errors.New("configuration error")
+
+// errUsage marks errors caused by invalid flags or arguments.
+var errUsage = errors.New("usage error")
+
+func usageError(cmd *cobra.Command, err error) error {
+	return fmt.Errorf("%w: %w", errUsage, err)
+}
+
+// validateFlags runs the flag checks cobra would otherwise run after the
+// pre-run hooks, so that their failures are reported as usage errors.
+func validateFlags(cmd *cobra.Command, args []string) error {
+	if err := cmd.ValidateRequiredFlags(); err != nil {
+		return usageError(cmd, err)
+	}
+	if err := cmd.ValidateFlagGroups(); err != nil {
+		return usageError(cmd, err)
+	}
+	return nil
+}
+
+// exitCode maps an error returned by a command onto the process exit code.
+func exitCode(err error) int {
+	// Commands like backup status define their own exit codes.
+	var coded interface{ ExitCode() int }
+	if errors.As(err, &coded) {
+		return coded.ExitCode()
+	}
+	for _, e := range errorExitCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return exitFailure
+}
@@ -1,29 +1,81 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 	"zxcvmk/cmd/backup"
+	"zxcvmk/cmd/daemon"
 	k8svolumes "zxcvmk/cmd/k8s-volumes"
+	"zxcvmk/cmd/serve"
+	"zxcvmk/cmd/systemd"
 	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/output"
+	"zxcvmk/pkg/providers"
 
 	"github.com/spf13/cobra"
 )
 
-func Execute() {
+func Execute() int {
 	backupArguments := backup.BackupArguments{}
 	replantArguments := k8svolumes.K8sArguments{}
+	serveArguments := serve.ServeArguments{}
+	apiArguments := serve.APIArguments{}
+	daemonArguments := daemon.DaemonArguments{}
+	systemdArguments := systemd.SystemdArguments{}
+	historyArguments := backup.HistoryArguments{}
 	var debugLevel bool
-	// get config location from env
-	config_location := os.Getenv("ZXCVMK_CONFIG")
-	defaultConfig := os.Getenv("HOME") + "/.config/zxcvmk/config.yaml"
-	if config_location == "" {
-		config_location = defaultConfig
+	var configFlag, config_location string
+	// the configuration is loaded lazily by the commands that need it, see
+	// loadConfig
+	var cfg *config.Config
+	loadConfig := func(cmd *cobra.Command) error {
+		mode := configMode(cmd)
+		if mode == "" {
+			return nil
+		}
+		var err error
+		config_location, err = config.Find(configFlag)
+		if errors.Is(err, config.ErrNotFound) && mode == configOptional {
+			slog.Debug("no configuration file found, using defaults")
+			cfg = &config.Config{}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errConfig, err)
+		}
+		cfg, err = config.LoadConfig(config_location)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errConfig, err)
+		}
+		return nil
 	}
-	cfg, err := config.LoadConfig(config_location)
 
 	rootCmd := &cobra.Command{
+		Use: "zxcvmk",
+		// errors are logged and mapped to an exit code in Execute
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateFlags(cmd, args); err != nil {
+				return err
+			}
+			if err := loadConfig(cmd); err != nil {
+				return err
+			}
+			// a command is a single run, daemon and serve start one per
+			// job or request
+			if cfg != nil {
+				cmd.SetContext(backup.WithRun(cmd.Context(), cfg))
+			}
+			return nil
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			SetupLogger(debugLevel)
 			fmt.Println("This is a root command. It does nothing.")
@@ -31,31 +83,160 @@ func Execute() {
 	}
 
 	backupCmd := &cobra.Command{
-		Use: "backup",
-		Run: func(cmd *cobra.Command, args []string) {
+		Use:         "backup",
+		Annotations: map[string]string{annotationConfig: configRequired},
+		RunE: func(cmd *cobra.Command, args []string) error {
 			SetupLogger(debugLevel)
-			backup.List(cfg, backupArguments)
+			return backup.List(cmd.Context(), cfg, backupArguments)
 		},
 	}
 
 	backupRestoreCmd := &cobra.Command{
 		Use: "restore",
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			SetupLogger(debugLevel)
-			backup.Restore(cfg, backupArguments)
+			return backup.Restore(cmd.Context(), cfg, backupArguments)
 		},
 	}
 
 	backupListCmd := &cobra.Command{
 		Use: "list",
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			SetupLogger(debugLevel)
-			backup.List(cfg, backupArguments)
+			return backup.List(cmd.Context(), cfg, backupArguments)
+		},
+	}
+
+	backupBrowseCmd := &cobra.Command{
+		Use:   "browse",
+		Short: "Browse snapshots at a prompt to preview, diff, dump or restore files",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return backup.Browse(cmd.Context(), cfg, backupArguments)
+		},
+	}
+
+	backupUnlockCmd := &cobra.Command{
+		Use:   "unlock",
+		Short: "Remove stale repository locks",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return backup.Unlock(cmd.Context(), cfg, backupArguments)
+		},
+	}
+
+	backupReplicateCmd := &cobra.Command{
+		Use:   "replicate",
+		Short: "Copy missing snapshots between repositories and report the replication lag",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return backup.Replicate(cmd.Context(), cfg, backupArguments)
+		},
+	}
+
+	backupStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Check the age of the latest snapshot of every backup target (Nagios plugin)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return backup.Status(cmd.Context(), cfg, backupArguments)
+		},
+	}
+
+	backupCheckCmd := &cobra.Command{
+		Use:   "check",
+		Short: "Verify the integrity of the repositories",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return backup.Check(cmd.Context(), cfg, backupArguments)
+		},
+	}
+
+	backupRunCmd := &cobra.Command{
+		Use:   "run",
+		Short: "Back up the backup targets",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return backup.Run(cmd.Context(), cfg, backupArguments)
+		},
+	}
+
+	backupPruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove snapshots outside of the retention policy",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return backup.Prune(cmd.Context(), cfg, backupArguments)
+		},
+	}
+
+	backupDrillCmd := &cobra.Command{
+		Use:   "drill",
+		Short: "Test-restore the latest snapshots into a staging directory",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return backup.Drill(cmd.Context(), cfg, backupArguments)
+		},
+	}
+
+	daemonCmd := &cobra.Command{
+		Use:         "daemon",
+		Short:       "Run the configured jobs on their schedule",
+		Annotations: map[string]string{annotationConfig: configRequired},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return daemon.Run(cmd.Context(), cfg, daemonArguments)
+		},
+	}
+
+	historyCmd := &cobra.Command{
+		Use:         "history [ID]",
+		Short:       "Show who restored, backed up, pruned or replanted what and when",
+		Args:        cobra.MaximumNArgs(1),
+		Annotations: map[string]string{annotationConfig: configOptional},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return backup.History(cmd.Context(), cfg, historyArguments, args)
+		},
+	}
+
+	systemdCmd := &cobra.Command{
+		Use:         "systemd",
+		Short:       "Integrate the configured jobs with systemd",
+		Annotations: map[string]string{annotationConfig: configRequired},
+	}
+
+	systemdGenerateCmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate service and timer units for the configured jobs",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return systemd.Generate(cmd.Context(), cfg, config_location, systemdArguments)
+		},
+	}
+
+	serveCmd := &cobra.Command{
+		Use:         "serve",
+		Short:       "Serve the REST API and web UI to browse snapshots and restore files",
+		Annotations: map[string]string{annotationConfig: configRequired},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return serve.API(cmd.Context(), cfg, backupArguments, apiArguments)
+		},
+	}
+
+	serveMetricsCmd := &cobra.Command{
+		Use:   "metrics",
+		Short: "Export Prometheus metrics of the backup targets",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			return serve.Metrics(cmd.Context(), cfg, backupArguments, serveArguments)
 		},
 	}
 
 	k8sCmd := &cobra.Command{
-		Use: "k8s",
+		Use:         "k8s",
+		Annotations: map[string]string{annotationConfig: configOptional},
 		Run: func(cmd *cobra.Command, args []string) {
 			SetupLogger(debugLevel)
 		},
@@ -63,34 +244,159 @@ func Execute() {
 
 	k8sVolumeReplantCmd := &cobra.Command{
 		Use: "k8s-volume-replant",
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			SetupLogger(debugLevel)
-			k8svolumes.Replant(cfg, replantArguments)
+			result, err := k8svolumes.Replant(cmd.Context(), cfg, replantArguments)
+			if err != nil {
+				return err
+			}
+			return output.Print(result, replantArguments.Output)
 		},
 	}
 
-	if err != nil {
-		slog.Error("Can't load config", "error", err)
-		return
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+
+	configValidateCmd := &cobra.Command{
+		Use:         "validate",
+		Short:       "Validate the configuration file",
+		Annotations: map[string]string{annotationConfig: configRequired},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			SetupLogger(debugLevel)
+			if err := cfg.ValidateHooks(); err != nil {
+				return fmt.Errorf("%w: %w", errConfig, err)
+			}
+			slog.Info("configuration is valid", "config", config_location)
+			return nil
+		},
+	}
+
+	configSchemaCmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON Schema of the configuration file",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Println(string(config.Schema))
+		},
 	}
 	rootCmd.AddCommand(backupCmd)
 	rootCmd.AddCommand(k8sCmd)
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configSchemaCmd)
 	backupCmd.AddCommand(backupRestoreCmd)
 	backupCmd.AddCommand(backupListCmd)
+	backupCmd.AddCommand(backupBrowseCmd)
+	backupCmd.AddCommand(backupUnlockCmd)
+	backupCmd.AddCommand(backupReplicateCmd)
+	backupCmd.AddCommand(backupStatusCmd)
+	backupCmd.AddCommand(backupCheckCmd)
+	backupCmd.AddCommand(backupRunCmd)
+	backupCmd.AddCommand(backupPruneCmd)
+	backupCmd.AddCommand(backupDrillCmd)
+	rootCmd.AddCommand(daemonCmd)
+	rootCmd.AddCommand(systemdCmd)
+	rootCmd.AddCommand(historyCmd)
+	systemdCmd.AddCommand(systemdGenerateCmd)
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.AddCommand(serveMetricsCmd)
 	k8sCmd.AddCommand(k8sVolumeReplantCmd)
 
+	rootCmd.SetFlagErrorFunc(usageError)
+	rootCmd.PersistentFlags().StringVar(&configFlag, "config", "", "Configuration file (default: $ZXCVMK_CONFIG, $XDG_CONFIG_HOME/zxcvmk/config.yaml, /etc/zxcvmk/config.yaml)")
 	rootCmd.PersistentFlags().BoolVar(&debugLevel, "debug", false, "Debug level")
 
+	backupCmd.PersistentFlags().StringArrayVar(&backupArguments.Repositories, "repo", []string{}, "Repository to use, \"all\" for every configured one (can be used multiple times)")
+	backupCmd.PersistentFlags().DurationVar(&backupArguments.RetryLock, "retry-lock", 0, "Wait up to this long for a locked repository")
+
 	backupRestoreCmd.Flags().StringVar(&backupArguments.SnapshotID, "snapshot-id", "", "Specify the snapshot ID")
 	backupRestoreCmd.Flags().StringArrayVar(&backupArguments.Paths, "filter-path", []string{}, "Specify the path filter (can be used multiple times)")
-	backupRestoreCmd.Flags().StringVar(&backupArguments.Output, "output", "", "Output type")
-	err = backupRestoreCmd.MarkFlagRequired("snapshot-ids")
-	if err == nil {
+	backupRestoreCmd.Flags().BoolVar(&backupArguments.InPlace, "in-place", false, "Restore directly over the live files, without a staging directory")
+	backupRestoreCmd.Flags().StringVar(&backupArguments.Overwrite, "overwrite", "if-changed", "Files an in-place restore replaces: always, if-changed, if-newer or never")
+	backupRestoreCmd.Flags().BoolVar(&backupArguments.Delete, "delete", false, "Delete files that are not in the snapshot (needs --in-place)")
+	backupRestoreCmd.Flags().BoolVar(&backupArguments.RestoreOptions.ACLs, "acls", false, "Preserve ACLs when copying restored files into place")
+	backupRestoreCmd.Flags().BoolVar(&backupArguments.RestoreOptions.Xattrs, "xattrs", false, "Preserve extended attributes when copying restored files into place")
+	backupRestoreCmd.Flags().BoolVar(&backupArguments.RestoreOptions.HardLinks, "hard-links", false, "Preserve hard links when copying restored files into place")
+	backupRestoreCmd.Flags().BoolVar(&backupArguments.RestoreOptions.NumericIDs, "numeric-ids", false, "Keep numeric owner IDs instead of mapping them by user and group name")
+	backupRestoreCmd.Flags().StringArrayVar(&backupArguments.MapUIDs, "map-uid", []string{}, "Give files owned by user ID FROM to TO, as FROM:TO (can be used multiple times)")
+	backupRestoreCmd.Flags().IntVar(&backupArguments.Parallel, "parallel", 2, "Restore up to this many targets at the same time")
+	backupRestoreCmd.Flags().StringVar(&backupArguments.RestoreOptions.Verify, "verify", "", "Compare the restored files with the snapshot: files (list and sizes) or hashes (also contents)")
+	backupRestoreCmd.Flags().BoolVar(&backupArguments.RestoreOptions.StrictVerify, "strict-verify", false, "Fail the restore when the restored files differ from the snapshot")
+	backupRestoreCmd.Flags().StringArrayVar(&backupArguments.MapGIDs, "map-gid", []string{}, "Give files owned by group ID FROM to TO, as FROM:TO (can be used multiple times)")
+	addOutputFlags(backupRestoreCmd, &backupArguments.Output)
+	err := backupRestoreCmd.MarkFlagRequired("snapshot-id")
+	if err != nil {
 		slog.Error("error setting up", "error", err)
-		return
+		return exitFailure
 	}
+	backupBrowseCmd.Flags().StringArrayVar(&backupArguments.Paths, "filter-path", []string{}, "Only offer these targets (can be used multiple times)")
+
 	backupListCmd.Flags().StringArrayVar(&backupArguments.Paths, "filter-path", []string{}, "Specify the path filter (can be used multiple times)")
-	backupListCmd.Flags().StringVar(&backupArguments.Output, "output", "", "Output type")
+	addOutputFlags(backupListCmd, &backupArguments.Output)
+	backupListCmd.Flags().StringArrayVar(&backupArguments.Filter.Hosts, "host", []string{}, "Only list snapshots of this host (can be used multiple times)")
+	backupListCmd.Flags().StringArrayVar(&backupArguments.Filter.Tags, "tag", []string{}, "Only list snapshots with this tag (can be used multiple times)")
+	backupListCmd.Flags().StringVar(&backupArguments.Filter.Since, "since", "", "Only list snapshots newer than a time, date or duration (e.g. 7d)")
+	backupListCmd.Flags().StringVar(&backupArguments.Filter.Until, "until", "", "Only list snapshots older than a time, date or duration")
+	backupListCmd.Flags().StringVar(&backupArguments.GroupBy, "group-by", "", "Print statistics per path, host or repository")
+	backupListCmd.Flags().BoolVar(&backupArguments.Stats, "stats", false, "Print statistics of all listed snapshots")
+	backupListCmd.Flags().DurationVar(&backupArguments.ExpectEvery, "expect-every", 24*time.Hour, "Expected snapshot interval, longer periods are reported as gaps")
+	backupListCmd.Flags().BoolVar(&backupArguments.Sizes, "size", false, "Compute the size of snapshots without a summary, or of the data of each group (slow)")
+
+	backupUnlockCmd.Flags().DurationVar(&backupArguments.UnlockOlderThan, "older-than", 30*time.Minute, "Remove locks older than this")
+	backupUnlockCmd.Flags().BoolVar(&backupArguments.DryRun, "dry-run", false, "Only report which locks would be removed")
+
+	backupReplicateCmd.Flags().StringVar(&backupArguments.From, "from", "", "Source repository")
+	backupReplicateCmd.Flags().StringVar(&backupArguments.To, "to", "", "Destination repository")
+	backupReplicateCmd.Flags().StringArrayVar(&backupArguments.Paths, "filter-path", []string{}, "Specify the path filter (can be used multiple times)")
+	backupReplicateCmd.Flags().BoolVar(&backupArguments.DryRun, "dry-run", false, "Only report the replication lag")
+	addOutputFlags(backupReplicateCmd, &backupArguments.Output)
+	_ = backupReplicateCmd.MarkFlagRequired("from")
+	_ = backupReplicateCmd.MarkFlagRequired("to")
+
+	backupStatusCmd.Flags().StringArrayVar(&backupArguments.Paths, "filter-path", []string{}, "Only check these backup targets (can be used multiple times)")
+	addOutputFlags(backupStatusCmd, &backupArguments.Output)
+	backupStatusCmd.Flag("output").Usage = "Output format: nagios, " + output.Formats
+
+	backupCheckCmd.Flags().StringVar(&backupArguments.ReadData, "read-data", "", "Also read and verify this part of the data, e.g. 5% or 1/7")
+
+	backupRunCmd.Flags().StringArrayVar(&backupArguments.Paths, "filter-path", []string{}, "Only back up these targets (can be used multiple times)")
+
+	backupPruneCmd.Flags().StringArrayVar(&backupArguments.Paths, "filter-path", []string{}, "Only prune snapshots of these paths (can be used multiple times)")
+	backupPruneCmd.Flags().BoolVar(&backupArguments.DryRun, "dry-run", false, "Only report which snapshots would be removed")
+
+	backupDrillCmd.Flags().StringArrayVar(&backupArguments.Paths, "filter-path", []string{}, "Only test these targets (can be used multiple times)")
+	addOutputFlags(backupDrillCmd, &backupArguments.Output)
+
+	daemonCmd.Flags().DurationVar(&daemonArguments.ShutdownTimeout, "shutdown-timeout", 5*time.Minute, "How long running jobs may take to finish on shutdown")
+	daemonCmd.Flags().BoolVar(&daemonArguments.DryRun, "dry-run", false, "Only list the jobs with their last and next run")
+	daemonCmd.Flags().StringVar(&daemonArguments.Job, "run", "", "Run this job once and exit")
+	addOutputFlags(daemonCmd, &daemonArguments.Output)
+
+	historyCmd.Flags().StringVar(&historyArguments.Operation, "operation", "", "Only show this operation: restore, backup, prune, replant, check or drill")
+	historyCmd.Flags().StringVar(&historyArguments.Target, "target", "", "Only show operations on this path, below it or containing it")
+	historyCmd.Flags().StringVar(&historyArguments.User, "user", "", "Only show operations run by this user, directly or through sudo")
+	historyCmd.Flags().StringVar(&historyArguments.Since, "since", "", "Only show operations newer than a time, date or duration (e.g. 7d)")
+	historyCmd.Flags().StringVar(&historyArguments.Until, "until", "", "Only show operations older than a time, date or duration")
+	historyCmd.Flags().BoolVar(&historyArguments.Failed, "failed", false, "Only show failed operations")
+	historyCmd.Flags().IntVar(&historyArguments.Limit, "limit", 50, "Show at most this many entries, 0 for all")
+	addOutputFlags(historyCmd, &historyArguments.Output)
+
+	systemdGenerateCmd.Flags().StringVar(&systemdArguments.Dir, "dir", "", "Write the units to this directory instead of printing them")
+	systemdGenerateCmd.Flags().BoolVar(&systemdArguments.Install, "install", false, "Install the units (to /etc/systemd/system unless --dir is set) and enable the timers")
+	systemdGenerateCmd.Flags().StringVar(&systemdArguments.Prefix, "prefix", "zxcvmk-", "Prefix of the unit names")
+	systemdGenerateCmd.Flags().StringArrayVar(&systemdArguments.OnFailure, "on-failure", []string{}, "Unit to start when a job fails, e.g. notify@%n.service (can be used multiple times)")
+
+	serveCmd.Flags().StringVar(&apiArguments.Listen, "listen", ":9843", "Address to serve the API and web UI on")
+	serveCmd.Flags().StringVar(&apiArguments.Token, "token", "", "Secret reference to the bearer token, e.g. env:ZXCVMK_TOKEN")
+	serveCmd.Flags().StringArrayVar(&apiArguments.BasicAuth, "basic-auth", nil, "Basic auth user as user:secret-reference, can be repeated")
+	serveCmd.Flags().BoolVar(&apiArguments.ReadOnly, "read-only", false, "Only browse and download, disable restores")
+	serveCmd.Flags().BoolVar(&apiArguments.NoAuth, "no-auth", false, "Serve without authentication")
+	serveCmd.Flags().DurationVar(&apiArguments.ShutdownTimeout, "shutdown-timeout", 5*time.Minute, "How long running restores may take to finish on shutdown")
+
+	serveMetricsCmd.Flags().StringVar(&serveArguments.Listen, "listen", ":9842", "Address to serve /metrics on")
+	serveMetricsCmd.Flags().DurationVar(&serveArguments.Interval, "interval", 5*time.Minute, "How often to refresh the metrics")
+	serveMetricsCmd.Flags().StringVar(&serveArguments.Textfile, "textfile", "", "Write the metrics once to this file for the node_exporter textfile collector")
 
 	k8sVolumeReplantCmd.Flags().StringVar(&replantArguments.PvcSrc, "pvc-src", "", "Specify the pvc source")
 	k8sVolumeReplantCmd.Flags().StringVar(&replantArguments.PvcDst, "pvc-dst", "", "Specify the pvc target")
@@ -100,23 +406,114 @@ func Execute() {
 	k8sVolumeReplantCmd.Flags().StringVar(&replantArguments.DestStorageClassName, "dst-storage-classname", "", "Specify the destination pvc classname")
 	k8sVolumeReplantCmd.Flags().StringVar(&replantArguments.DeploymentVolumeName, "deployment-volume-name", "", "Specify the deployment volume name to replace")
 	k8sVolumeReplantCmd.Flags().BoolVar(&replantArguments.DryRun, "dry-run", false, "dry-run")
+	addOutputFlags(k8sVolumeReplantCmd, &replantArguments.Output)
 
 	err = k8sVolumeReplantCmd.MarkFlagRequired("dst-size")
 	if err != nil {
 		slog.Error("dst-size is not provided")
-		return
+		return exitFailure
 	}
 	err = k8sVolumeReplantCmd.MarkFlagRequired("dst-storage-classname")
 	if err != nil {
 		slog.Error("dst-storage-classname is not provided")
-		return
+		return exitFailure
 	}
 	// err = k8sVolumeReplantCmd.MarkFlagRequired("deployment-volume-name")
 	// if err != nil {
 	// 	slog.Error("deployment-volume-name is not provided")
 	// 	return
 	// }
-	_ = rootCmd.Execute()
+
+	// completions load the configuration themselves, __complete does not run
+	// the PersistentPreRunE hooks
+	completeWithConfig := func(complete func(cmd *cobra.Command) ([]string, cobra.ShellCompDirective)) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if err := loadConfig(cmd); err != nil || cfg == nil {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			return complete(cmd)
+		}
+	}
+	completeTargets := completeWithConfig(func(cmd *cobra.Command) ([]string, cobra.ShellCompDirective) {
+		return targetCompletions(cfg), cobra.ShellCompDirectiveNoFileComp
+	})
+	for _, cmd := range []*cobra.Command{backupRestoreCmd, backupBrowseCmd, backupListCmd, backupReplicateCmd, backupStatusCmd, backupRunCmd, backupPruneCmd, backupDrillCmd} {
+		_ = cmd.RegisterFlagCompletionFunc("filter-path", completeTargets)
+	}
+	_ = historyCmd.RegisterFlagCompletionFunc("target", completeTargets)
+	_ = backupCmd.RegisterFlagCompletionFunc("repo", completeWithConfig(func(cmd *cobra.Command) ([]string, cobra.ShellCompDirective) {
+		return repositoryCompletions(cfg, true), cobra.ShellCompDirectiveNoFileComp
+	}))
+	completeRepositories := completeWithConfig(func(cmd *cobra.Command) ([]string, cobra.ShellCompDirective) {
+		return repositoryCompletions(cfg, false), cobra.ShellCompDirectiveNoFileComp
+	})
+	_ = backupReplicateCmd.RegisterFlagCompletionFunc("from", completeRepositories)
+	_ = backupReplicateCmd.RegisterFlagCompletionFunc("to", completeRepositories)
+	_ = backupRestoreCmd.RegisterFlagCompletionFunc("overwrite", cobra.FixedCompletions(providers.OverwriteModes, cobra.ShellCompDirectiveNoFileComp))
+	_ = backupRestoreCmd.RegisterFlagCompletionFunc("verify", cobra.FixedCompletions(config.VerifyModes, cobra.ShellCompDirectiveNoFileComp))
+	_ = backupRestoreCmd.RegisterFlagCompletionFunc("snapshot-id", completeWithConfig(func(cmd *cobra.Command) ([]string, cobra.ShellCompDirective) {
+		key := []string{"snapshots", config_location, strings.Join(backupArguments.Repositories, ","), strings.Join(backupArguments.Paths, ",")}
+		return cachedCompletion(key, func() ([]string, error) {
+			return snapshotCompletions(completionContext(cmd), cfg, backupArguments)
+		})
+	}))
+	_ = daemonCmd.RegisterFlagCompletionFunc("run", completeWithConfig(func(cmd *cobra.Command) ([]string, cobra.ShellCompDirective) {
+		return jobCompletions(cfg), cobra.ShellCompDirectiveNoFileComp
+	}))
+	_ = k8sVolumeReplantCmd.RegisterFlagCompletionFunc("namespace", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return cachedCompletion([]string{"namespaces"}, func() ([]string, error) {
+			return k8svolumes.CompleteNamespaces(completionContext(cmd))
+		})
+	})
+	completePvcs := func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return cachedCompletion([]string{"pvcs", replantArguments.Namespace}, func() ([]string, error) {
+			return k8svolumes.CompletePvcs(completionContext(cmd), replantArguments)
+		})
+	}
+	_ = k8sVolumeReplantCmd.RegisterFlagCompletionFunc("pvc-src", completePvcs)
+	_ = k8sVolumeReplantCmd.RegisterFlagCompletionFunc("pvc-dst", completePvcs)
+	_ = k8sVolumeReplantCmd.RegisterFlagCompletionFunc("deployment", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return cachedCompletion([]string{"deployments", replantArguments.Namespace, replantArguments.PvcSrc}, func() ([]string, error) {
+			return k8svolumes.CompleteDeployments(completionContext(cmd), replantArguments)
+		})
+	})
+
+	// SIGINT/SIGTERM cancel the context, commands are responsible for running
+	// their compensating steps (post-restore hooks, scaling deployments back
+	// up, ...) before returning
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	cmd, err := rootCmd.ExecuteContextC(ctx)
+	if err != nil {
+		slog.Error("command failed", "command", cmd.CommandPath(), "error", err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+// Commands annotated with annotationConfig, and their subcommands, load the
+// configuration before running. configRequired fails when no configuration
+// file exists, configOptional falls back to an empty configuration.
+const (
+	annotationConfig = "zxcvmk/config"
+	configRequired   = "required"
+	configOptional   = "optional"
+)
+
+func configMode(cmd *cobra.Command) string {
+	for ; cmd != nil; cmd = cmd.Parent() {
+		if mode, ok := cmd.Annotations[annotationConfig]; ok {
+			return mode
+		}
+	}
+	return ""
+}
+
+// addOutputFlags registers the flags selecting the output format of cmd.
+func addOutputFlags(cmd *cobra.Command, opts *output.Options) {
+	cmd.Flags().StringVarP(&opts.Format, "output", "o", "", "Output format: "+output.Formats)
+	cmd.Flags().StringSliceVar(&opts.Columns, "columns", []string{}, "Columns to show in table, wide, csv and tsv output")
+	cmd.Flags().StringVar(&opts.SortBy, "sort-by", "", "Column to sort table output by, prefix with - to sort descending")
 }
 
 func SetupLogger(debugLevel bool) {
@@ -131,12 +528,13 @@ func SetupLogger(debugLevel bool) {
 		Level: slogLevel,
 	}
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &handlerOptions))
+	// stdout is reserved for command output
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &handlerOptions))
 	slog.SetDefault(logger)
 
 	slog.Info("Debug level", "debugLevel", debugLevel)
 }
 
 func main() {
-	Execute()
+	os.Exit(Execute())
 }
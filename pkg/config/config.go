@@ -1,73 +1,500 @@
 package config
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	// "github.com/jedib0t/go-pretty/v6/table"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
+// LoadConfig reads the configuration file and the files it includes, and
+// validates the result.
 func LoadConfig(filename string) (*Config, error) {
+	config, err := loadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include %q: %w", filename, pattern, err)
+		}
+		// Glob returns the matches sorted, conf.d files apply in name order
+		for _, match := range matches {
+			included, err := loadFile(match)
+			if err != nil {
+				return nil, err
+			}
+			if len(included.Include) > 0 {
+				return nil, fmt.Errorf("%s: included files cannot include further files", match)
+			}
+			config.merge(included)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadFile reads a single configuration file, expanding ${ENV} references in
+// its values.
+func loadFile(filename string) (*Config, error) {
 	// Read the contents of the file
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	// Declare a Config variable
-	var config Config
+	// Decode strictly, so that misspelled keys are reported instead of
+	// silently ignored. Only unknown keys count, the values are checked
+	// after interpolation, ${PORT} is not an int yet.
+	var strict Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&strict); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		var unknown []string
+		for _, msg := range typeErr.Errors {
+			if strings.Contains(msg, " not found in type ") {
+				unknown = append(unknown, msg)
+			}
+		}
+		if len(unknown) > 0 {
+			return nil, fmt.Errorf("%s: %w", filename, &yaml.TypeError{Errors: unknown})
+		}
+	}
 
-	// Unmarshal the YAML data into the Config struct
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, err
+	// The values are decoded from the document after interpolation, which
+	// also keeps the node positions around for validation errors
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if err := interpolate(&root); err != nil {
+		return nil, fmt.Errorf("%s:%w", filename, err)
 	}
 
+	// Declare a Config variable
+	var config Config
+	if len(root.Content) > 0 {
+		if err := root.Decode(&config); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	config.node = &root
+	config.filename = filename
+	for i := range config.BackupProviders {
+		config.BackupProviders[i].origin = &origin{config: &config, index: i}
+	}
+	for i := range config.BackupTargets {
+		config.BackupTargets[i].origin = &origin{config: &config, index: i}
+	}
+	for i := range config.Jobs {
+		config.Jobs[i].origin = &origin{config: &config, index: i}
+	}
+	if config.Notifications != nil {
+		config.Notifications.origin = &config
+	}
 	return &config, nil
 }
 
+// merge adds the repositories and targets of an included file. Settings of
+// the including file take precedence.
+func (c *Config) merge(included *Config) {
+	c.BackupProviders = append(c.BackupProviders, included.BackupProviders...)
+	c.BackupTargets = append(c.BackupTargets, included.BackupTargets...)
+	if c.BackupProvider == "" {
+		c.BackupProvider = included.BackupProvider
+	}
+	if c.MountCommand == "" {
+		c.MountCommand = included.MountCommand
+	}
+	if c.AgeKeyFile == "" {
+		c.AgeKeyFile = included.AgeKeyFile
+	}
+	if c.MaxAge == "" {
+		c.MaxAge = included.MaxAge
+	}
+	if c.MaxAgeCritical == "" {
+		c.MaxAgeCritical = included.MaxAgeCritical
+	}
+	if c.StateDir == "" {
+		c.StateDir = included.StateDir
+	}
+	if c.StagingDir == "" {
+		c.StagingDir = included.StagingDir
+	}
+	if c.Restore == nil {
+		c.Restore = included.Restore
+	}
+	if c.Retention == nil {
+		c.Retention = included.Retention
+	}
+	c.Jobs = append(c.Jobs, included.Jobs...)
+	if c.Notifications == nil {
+		c.Notifications = included.Notifications
+	}
+}
+
 type BackupTarget struct {
 	Location        string   `yaml:"location"`
 	PreRestoreHook  []string `yaml:"pre-restore-hook"`
 	PostRestoreHook []string `yaml:"post-restore-hook"`
+	// Repositories lists the names of the backupProviders entries holding
+	// this target. Empty means the default backupProvider.
+	Repositories []string `yaml:"repositories"`
+	// MaxAge and MaxAgeCritical override the freshness thresholds of
+	// Config for this target.
+	MaxAge         string `yaml:"maxAge"`
+	MaxAgeCritical string `yaml:"maxAgeCritical"`
+	// StagingDir overrides the global stagingDir for restores of this
+	// target.
+	StagingDir string `yaml:"stagingDir"`
+	// Restore overrides the global restore options for this target.
+	Restore *RestoreOptions `yaml:"restore"`
+
+	origin *origin
 }
 
 type Config struct {
+	// BackupProvider is the name of the default repository.
 	BackupProvider  string           `yaml:"backupProvider"`
 	BackupProviders []BackupProvider `yaml:"backupProviders"`
 	MountCommand    string           `yaml:"mountCommand"`
 	BackupTargets   []BackupTarget   `yaml:"backupTargets"`
+	// AgeKeyFile is the age identity used to decrypt sops: secrets.
+	AgeKeyFile string `yaml:"ageKeyFile"`
+	// Include lists glob patterns of further configuration files, relative
+	// to this file. Their repositories and targets are added to this one.
+	Include []string `yaml:"include"`
+	// MaxAge is the age of the latest snapshot of a target above which
+	// `backup status` warns, MaxAgeCritical the age above which it is
+	// critical. They default to 26h and twice MaxAge.
+	MaxAge         string `yaml:"maxAge"`
+	MaxAgeCritical string `yaml:"maxAgeCritical"`
+	// StateDir holds the state zxcvmk keeps between runs, such as the
+	// outcome of the last restore. See StateDirectory for the default.
+	StateDir string `yaml:"stateDir"`
+	// StagingDir is where snapshots are restored to before they are copied
+	// into place. It defaults to the system temporary directory, which is
+	// often a small tmpfs.
+	StagingDir string `yaml:"stagingDir"`
+	// Restore selects the metadata preserved when restoring.
+	Restore *RestoreOptions `yaml:"restore"`
+	// Retention is the snapshot retention policy of `backup prune`.
+	Retention *Retention `yaml:"retention"`
+	// Jobs are run on their schedule by `zxcvmk daemon`.
+	Jobs []Job `yaml:"jobs"`
+	// Notifications routes events such as failed restores to notifiers.
+	Notifications *Notifications `yaml:"notifications"`
+
+	node     *yaml.Node
+	filename string
+}
+
+// RestoreOptions select the metadata preserved when restored files are
+// copied into place.
+type RestoreOptions struct {
+	// ACLs, Xattrs and HardLinks preserve POSIX ACLs, extended attributes
+	// and hard links (rsync -A, -X and -H).
+	ACLs      bool `yaml:"acls"`
+	Xattrs    bool `yaml:"xattrs"`
+	HardLinks bool `yaml:"hardLinks"`
+	// NumericIDs keeps the user and group IDs instead of mapping them by
+	// name (rsync --numeric-ids).
+	NumericIDs bool `yaml:"numericIds"`
+	// UIDMap and GIDMap map the IDs recorded in the snapshot to the IDs on
+	// the restore host, e.g. after rebuilding it or for containers.
+	UIDMap map[int]int `yaml:"uidMap"`
+	GIDMap map[int]int `yaml:"gidMap"`
+	// Verify compares the restored files with the snapshot: "files"
+	// compares the file list and sizes, "hashes" also the contents. Empty
+	// skips the verification.
+	Verify string `yaml:"verify"`
+	// StrictVerify fails the restore when the verification finds a
+	// difference, it verifies the files if Verify is not set.
+	StrictVerify bool `yaml:"strictVerify"`
+}
+
+// Verification modes of RestoreOptions.Verify.
+const (
+	VerifyFiles  = "files"
+	VerifyHashes = "hashes"
+)
+
+// VerifyModes are the valid RestoreOptions.Verify values.
+var VerifyModes = []string{VerifyFiles, VerifyHashes}
+
+// RestoreOptions returns the restore options of the target containing
+// location, else the global ones.
+func (c *Config) RestoreOptions(location string) RestoreOptions {
+	if target, ok := c.TargetOf(location); ok && target.Restore != nil {
+		return *target.Restore
+	}
+	if c.Restore != nil {
+		return *c.Restore
+	}
+	return RestoreOptions{}
+}
+
+// Retention selects the snapshots kept when pruning, as the restic forget
+// --keep-* options.
+type Retention struct {
+	KeepLast    int `yaml:"keepLast"`
+	KeepHourly  int `yaml:"keepHourly"`
+	KeepDaily   int `yaml:"keepDaily"`
+	KeepWeekly  int `yaml:"keepWeekly"`
+	KeepMonthly int `yaml:"keepMonthly"`
+	KeepYearly  int `yaml:"keepYearly"`
+	// KeepWithin is in the restic duration format, e.g. "1y6m" or "14d".
+	KeepWithin string `yaml:"keepWithin"`
+}
+
+// IsZero reports whether the policy keeps nothing, pruning with it would
+// remove every snapshot.
+func (r Retention) IsZero() bool {
+	return r == Retention{}
+}
+
+// Job types run by the daemon.
+const (
+	JobBackup = "backup"
+	JobPrune  = "prune"
+	JobCheck  = "check"
+	JobDrill  = "drill"
+)
+
+// Job is a scheduled run of a backup command.
+type Job struct {
+	Name string `yaml:"name"`
+	// Type is one of backup, prune, check or drill.
+	Type string `yaml:"type"`
+	// Schedule is a cron expression, e.g. "30 3 * * *" or "@daily".
+	Schedule string `yaml:"schedule"`
+	// Jitter delays each run by a random duration up to this, e.g. "15m".
+	Jitter string `yaml:"jitter"`
+	// Paths and Repositories select the targets and repositories as the
+	// --filter-path and --repo flags do.
+	Paths        []string `yaml:"paths"`
+	Repositories []string `yaml:"repositories"`
+	// ReadData is passed to check jobs, see `backup check --read-data`.
+	ReadData string `yaml:"readData"`
+	// Retention overrides the global retention of prune jobs.
+	Retention *Retention `yaml:"retention"`
+
+	origin *origin
+}
+
+// Notifications configures where events are sent.
+type Notifications struct {
+	Notifiers []Notifier          `yaml:"notifiers"`
+	Routes    []NotificationRoute `yaml:"routes"`
+	// RateLimit sends the same event type for the same target to a
+	// notifier at most once per this duration, e.g. "1h".
+	RateLimit string `yaml:"rateLimit"`
+
+	// origin is the file defining the notifications
+	origin *Config
+}
+
+// Notifier types.
+const (
+	NotifierWebhook = "webhook"
+	NotifierNtfy    = "ntfy"
+	NotifierGotify  = "gotify"
+	NotifierMatrix  = "matrix"
+	NotifierSMTP    = "smtp"
+)
+
+// Notifier is a named notification channel. Which fields apply depends on
+// Type.
+type Notifier struct {
+	Name string `yaml:"name"`
+	// Type is one of webhook, ntfy, gotify, matrix or smtp.
+	Type string `yaml:"type"`
+	// URL is the webhook URL, the ntfy topic URL, the Gotify server or the
+	// Matrix homeserver.
+	URL string `yaml:"url"`
+	// Token is a secret reference to the ntfy access token, Gotify
+	// application token or Matrix access token.
+	Token string `yaml:"token"`
+	// Room is the Matrix room ID.
+	Room string `yaml:"room"`
+	// Priority overrides the ntfy or Gotify priority derived from the
+	// event severity.
+	Priority int `yaml:"priority"`
+	// Template is a Go template rendering the webhook body from the event,
+	// the event as JSON by default.
+	Template string            `yaml:"template"`
+	Headers  map[string]string `yaml:"headers"`
+	// Host, Port, Username, Password (a secret reference), From and To
+	// configure SMTP.
+	Host     string   `yaml:"host"`
+	Port     int      `yaml:"port"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// NotificationRoute sends the events matching one of Events, glob patterns
+// such as "*.failed" or "restore.*", to Notifiers.
+type NotificationRoute struct {
+	Events    []string `yaml:"events"`
+	Notifiers []string `yaml:"notifiers"`
+	// RateLimit overrides the global rate limit for this route.
+	RateLimit string `yaml:"rateLimit"`
 }
 
 // BackupProvider provides detailed information about a specific backup provider.
+// Each entry is a named repository, Type selects the tool used to access it.
 type BackupProvider struct {
-	Name                             string   `yaml:"name"`
-	SnapshotListCommand              []string `yaml:"snapshotListCommand"`
-	BackupRepositoryPasswordLocation string   `yaml:"backupRepositoryPasswordLocation"`
-	BackupRepository                 string   `yaml:"backupRepository"`
+	Name string `yaml:"name"`
+	// Type is the provider implementation, e.g. "restic". It defaults to Name
+	// so that entries named after their tool keep working.
+	Type                string   `yaml:"type"`
+	SnapshotListCommand []string `yaml:"snapshotListCommand"`
+	// BackupRepositoryPasswordLocation is a secret reference, see
+	// secrets.Resolver for the supported sources. A plain path is read as a
+	// file.
+	BackupRepositoryPasswordLocation string `yaml:"backupRepositoryPasswordLocation"`
+	BackupRepository                 string `yaml:"backupRepository"`
+	// RetryLock is how long to wait for a locked repository, e.g. "5m".
+	RetryLock string `yaml:"retryLock"`
+
+	origin *origin
 }
 
-// Output outputs the given data into a supported format
-func Output(data any, output string) (string, error) {
-	switch output {
-	case "json":
-		jsonData, err := json.MarshalIndent(data, "", "  ")
-		if err != nil {
-			return "", err
+// ProviderType returns the provider implementation of the repository.
+func (b BackupProvider) ProviderType() string {
+	if b.Type != "" {
+		return b.Type
+	}
+	return b.Name
+}
+
+// Repository returns the backupProviders entry with the given name.
+func (c *Config) Repository(name string) (BackupProvider, bool) {
+	for _, provider := range c.BackupProviders {
+		if provider.Name == name {
+			return provider, true
+		}
+	}
+	return BackupProvider{}, false
+}
+
+// Target returns the backupTargets entry at location.
+func (c *Config) Target(location string) (BackupTarget, bool) {
+	for _, target := range c.BackupTargets {
+		if target.Location == location {
+			return target, true
 		}
-		return string(jsonData), nil
+	}
+	return BackupTarget{}, false
+}
+
+// TargetOf returns the backupTargets entry containing path, the innermost one
+// if targets are nested.
+func (c *Config) TargetOf(path string) (BackupTarget, bool) {
+	var found BackupTarget
+	for _, target := range c.BackupTargets {
+		location := strings.TrimSuffix(target.Location, "/")
+		if (path == location || strings.HasPrefix(path, location+"/")) && len(location) >= len(found.Location) {
+			found = target
+		}
+	}
+	return found, found.Location != ""
+}
+
+// DefaultMaxAge is the freshness threshold used when none is configured.
+const DefaultMaxAge = 26 * time.Hour
+
+// Freshness returns the warning and critical snapshot age of a target.
+func (c *Config) Freshness(target BackupTarget) (warn, crit time.Duration, err error) {
+	warn = DefaultMaxAge
+	for _, spec := range []string{c.MaxAge, target.MaxAge} {
+		if spec != "" {
+			if warn, err = ParseDuration(spec); err != nil {
+				return 0, 0, fmt.Errorf("invalid maxAge %q: %w", spec, err)
+			}
+		}
+	}
+	crit = 2 * warn
+	for _, spec := range []string{c.MaxAgeCritical, target.MaxAgeCritical} {
+		if spec != "" {
+			if crit, err = ParseDuration(spec); err != nil {
+				return 0, 0, fmt.Errorf("invalid maxAgeCritical %q: %w", spec, err)
+			}
+		}
+	}
+	return warn, crit, nil
+}
 
-	case "yaml":
-		yamlData, err := yaml.Marshal(data)
+// ParseDuration is time.ParseDuration with support for whole days, e.g. "7d".
+func ParseDuration(spec string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(spec, "d"); ok {
+		n, err := strconv.Atoi(days)
 		if err != nil {
-			return "", err
+			return 0, fmt.Errorf("invalid duration %q", spec)
 		}
-		return string(yamlData), nil
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(spec)
+}
 
-	case "table":
-		// TODO: table export
-		return "", nil
+// TargetRepositories returns the repositories holding the target containing
+// location.
+func (c *Config) TargetRepositories(location string) []string {
+	if target, ok := c.TargetOf(location); ok && len(target.Repositories) > 0 {
+		return target.Repositories
+	}
+	return []string{c.BackupProvider}
+}
 
+// StagingDirectory returns the stagingDir of the target containing location,
+// else the global one, else the system temporary directory.
+func (c *Config) StagingDirectory(location string) string {
+	if target, ok := c.TargetOf(location); ok && target.StagingDir != "" {
+		return target.StagingDir
+	}
+	if c.StagingDir != "" {
+		return c.StagingDir
+	}
+	return os.TempDir()
+}
+
+// StateDirectory returns the configured stateDir, or /var/lib/zxcvmk for root
+// and $XDG_STATE_HOME/zxcvmk (~/.local/state/zxcvmk) for other users.
+func (c *Config) StateDirectory() string {
+	if c.StateDir != "" {
+		return c.StateDir
+	}
+	if os.Geteuid() == 0 {
+		return "/var/lib/zxcvmk"
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "zxcvmk")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "zxcvmk")
 	}
-	return "", nil
+	return filepath.Join(home, ".local", "state", "zxcvmk")
 }
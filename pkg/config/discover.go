@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNotFound is returned by Find when no configuration file exists.
+var ErrNotFound = errors.New("no configuration file found")
+
+// SearchPaths returns the locations searched for the configuration file, in
+// order: $ZXCVMK_CONFIG, the XDG config directories and /etc/zxcvmk.
+func SearchPaths() []string {
+	var paths []string
+	if env := os.Getenv("ZXCVMK_CONFIG"); env != "" {
+		paths = append(paths, env)
+	}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		paths = append(paths, filepath.Join(configHome, "zxcvmk", "config.yaml"))
+	}
+	configDirs := os.Getenv("XDG_CONFIG_DIRS")
+	if configDirs == "" {
+		configDirs = "/etc/xdg"
+	}
+	for _, dir := range filepath.SplitList(configDirs) {
+		if dir != "" {
+			paths = append(paths, filepath.Join(dir, "zxcvmk", "config.yaml"))
+		}
+	}
+	return append(paths, "/etc/zxcvmk/config.yaml")
+}
+
+// Find returns the configuration file to use. An explicit path, e.g. from
+// --config, must exist, otherwise the first existing SearchPaths entry wins.
+func Find(explicit string) (string, error) {
+	if explicit != "" {
+		if _, err := os.Stat(explicit); err != nil {
+			return "", err
+		}
+		return explicit, nil
+	}
+	paths := SearchPaths()
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%w, searched %s", ErrNotFound, strings.Join(paths, ", "))
+}
+
+// envRe matches ${NAME} and ${NAME:-default}. $${NAME} escapes a literal
+// ${NAME}.
+var envRe = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolate expands environment variable references in all scalar values
+// of the document. Keys are left alone.
+func interpolate(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return nil
+		}
+		var err error
+		if node.Style == 0 {
+			// let the expanded value resolve to its own type, e.g. !!int
+			node.Tag = ""
+		}
+		node.Value = envRe.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			if strings.HasPrefix(ref, "$$") {
+				return ref[1:]
+			}
+			m := envRe.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(m[1]); ok {
+				return value
+			}
+			if m[2] != "" {
+				return m[3]
+			}
+			if err == nil {
+				err = fmt.Errorf("%d:%d: environment variable %s is not set", node.Line, node.Column, m[1])
+			}
+			return ref
+		})
+		return err
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := interpolate(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, child := range node.Content {
+			if err := interpolate(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
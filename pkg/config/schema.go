@@ -0,0 +1,9 @@
+package config
+
+import _ "embed"
+
+// Schema is the JSON Schema of the configuration file, for editor completion
+// and validation.
+//
+//go:embed schema.json
+var Schema []byte
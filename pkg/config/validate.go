@@ -0,0 +1,471 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	pathpkg "path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"zxcvmk/pkg/schedule"
+
+	"gopkg.in/yaml.v3"
+)
+
+// supportedProviderTypes are the provider implementations known to the tool.
+var supportedProviderTypes = []string{"restic"}
+
+// ValidationError is a single problem found in the configuration.
+type ValidationError struct {
+	File    string
+	Line    int
+	Column  int
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File + ":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d:%d:", e.Line, e.Column)
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	return b.String() + e.Field + ": " + e.Message
+}
+
+// ValidationErrors collects every problem found by a validation pass.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return "invalid configuration:\n" + strings.Join(msgs, "\n")
+}
+
+type validator struct {
+	cfg  *Config
+	errs ValidationErrors
+}
+
+// origin records where a list entry was defined, as entries can come from
+// included files.
+type origin struct {
+	config *Config
+	index  int
+}
+
+// errorf records a problem at the YAML node addressed by path, a sequence of
+// mapping keys and sequence indexes, e.g. "backupTargets", 2, "location".
+func (v *validator) errorf(path []any, format string, args ...any) {
+	err := &ValidationError{
+		File:    v.cfg.filename,
+		Field:   fieldName(path),
+		Message: fmt.Sprintf(format, args...),
+	}
+	source, sourcePath := v.cfg, path
+	if o := v.origin(path); o != nil {
+		source = o.config
+		sourcePath = append([]any{path[0], o.index}, path[2:]...)
+	} else if len(path) > 0 && path[0] == "notifications" && v.cfg.Notifications != nil && v.cfg.Notifications.origin != nil {
+		// included files can only provide the whole notifications block
+		source = v.cfg.Notifications.origin
+	}
+	err.File = source.filename
+	if node := lookupNode(source.node, sourcePath); node != nil {
+		err.Line, err.Column = node.Line, node.Column
+	}
+	v.errs = append(v.errs, err)
+}
+
+func (v *validator) origin(path []any) *origin {
+	if len(path) < 2 {
+		return nil
+	}
+	i, ok := path[1].(int)
+	if !ok {
+		return nil
+	}
+	switch path[0] {
+	case "backupProviders":
+		return v.cfg.BackupProviders[i].origin
+	case "backupTargets":
+		return v.cfg.BackupTargets[i].origin
+	case "jobs":
+		return v.cfg.Jobs[i].origin
+	}
+	return nil
+}
+
+func (v *validator) result() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Validate checks the configuration for semantic errors, such as references
+// to repositories that do not exist or relative target locations.
+func (c *Config) Validate() error {
+	v := &validator{cfg: c}
+
+	names := map[string]bool{}
+	for i, provider := range c.BackupProviders {
+		path := []any{"backupProviders", i}
+		if provider.Name == "" {
+			v.errorf(path, "name is required")
+		} else if names[provider.Name] {
+			v.errorf(append(path, "name"), "duplicate repository name %q", provider.Name)
+		}
+		names[provider.Name] = true
+		if !slices.Contains(supportedProviderTypes, provider.ProviderType()) {
+			field := "name"
+			if provider.Type != "" {
+				field = "type"
+			}
+			v.errorf(append(path, field), "unsupported provider type %q, expected one of %s", provider.ProviderType(), strings.Join(supportedProviderTypes, ", "))
+		}
+		if provider.BackupRepository == "" {
+			v.errorf(path, "backupRepository is required")
+		}
+		if provider.RetryLock != "" {
+			if _, err := time.ParseDuration(provider.RetryLock); err != nil {
+				v.errorf(append(path, "retryLock"), "invalid duration: %s", err)
+			}
+		}
+	}
+
+	if c.BackupProvider == "" {
+		if len(c.BackupProviders) > 0 {
+			v.errorf([]any{}, "backupProvider is required")
+		}
+	} else if !names[c.BackupProvider] {
+		v.errorf([]any{"backupProvider"}, "repository %q is not defined in backupProviders", c.BackupProvider)
+	}
+
+	locations := map[string]int{}
+	for i, target := range c.BackupTargets {
+		path := []any{"backupTargets", i}
+		switch {
+		case target.Location == "":
+			v.errorf(path, "location is required")
+		case !filepath.IsAbs(target.Location):
+			v.errorf(append(path, "location"), "location %q must be an absolute path", target.Location)
+		case filepath.Clean(target.Location) != target.Location:
+			v.errorf(append(path, "location"), "location %q is not clean, use %q", target.Location, filepath.Clean(target.Location))
+		}
+		if first, ok := locations[target.Location]; ok {
+			v.errorf(append(path, "location"), "duplicate location %q, already used by backupTargets[%d]", target.Location, first)
+		} else {
+			locations[target.Location] = i
+		}
+		for j, repo := range target.Repositories {
+			if !names[repo] {
+				v.errorf(append(path, "repositories", j), "repository %q is not defined in backupProviders", repo)
+			}
+		}
+		if target.MaxAge != "" || target.MaxAgeCritical != "" {
+			c.validateFreshness(v, path, target)
+		}
+		if target.StagingDir != "" && !filepath.IsAbs(target.StagingDir) {
+			v.errorf(append(path, "stagingDir"), "stagingDir %q must be an absolute path", target.StagingDir)
+		}
+		if target.Restore != nil {
+			validateRestoreOptions(v, append(path, "restore"), *target.Restore)
+		}
+		for _, hook := range []struct {
+			key     string
+			command []string
+		}{{"pre-restore-hook", target.PreRestoreHook}, {"post-restore-hook", target.PostRestoreHook}} {
+			if hook.command != nil && (len(hook.command) == 0 || hook.command[0] == "") {
+				v.errorf(append(path, hook.key), "hook command is empty")
+			}
+		}
+	}
+
+	if c.MaxAge != "" || c.MaxAgeCritical != "" {
+		c.validateFreshness(v, []any{}, BackupTarget{})
+	}
+	if c.StagingDir != "" && !filepath.IsAbs(c.StagingDir) {
+		v.errorf([]any{"stagingDir"}, "stagingDir %q must be an absolute path", c.StagingDir)
+	}
+	if c.Restore != nil {
+		validateRestoreOptions(v, []any{"restore"}, *c.Restore)
+	}
+	if c.Retention != nil {
+		c.validateRetention(v, []any{"retention"}, *c.Retention)
+	}
+	jobs := map[string]bool{}
+	for i, job := range c.Jobs {
+		path := []any{"jobs", i}
+		if job.Name == "" {
+			v.errorf(path, "name is required")
+		} else if jobs[job.Name] {
+			v.errorf(append(path, "name"), "duplicate job name %q", job.Name)
+		}
+		jobs[job.Name] = true
+		if !slices.Contains(jobTypes, job.Type) {
+			v.errorf(append(path, "type"), "unsupported job type %q, expected one of %s", job.Type, strings.Join(jobTypes, ", "))
+		}
+		if job.Schedule == "" {
+			v.errorf(path, "schedule is required")
+		} else if _, err := schedule.Parse(job.Schedule); err != nil {
+			v.errorf(append(path, "schedule"), "%s", err)
+		}
+		if job.Jitter != "" {
+			if _, err := ParseDuration(job.Jitter); err != nil {
+				v.errorf(append(path, "jitter"), "invalid duration: %s", err)
+			}
+		}
+		for j, location := range job.Paths {
+			if _, ok := locations[location]; !ok {
+				v.errorf(append(path, "paths", j), "%q is not a backup target location", location)
+			}
+		}
+		for j, repo := range job.Repositories {
+			if repo != "all" && !names[repo] {
+				v.errorf(append(path, "repositories", j), "repository %q is not defined in backupProviders", repo)
+			}
+		}
+		if job.Retention != nil {
+			c.validateRetention(v, append(path, "retention"), *job.Retention)
+		} else if job.Type == JobPrune && c.Retention == nil {
+			v.errorf(path, "prune jobs need a retention, set it on the job or globally")
+		}
+	}
+	if c.Notifications != nil {
+		c.validateNotifications(v, c.Notifications)
+	}
+	return v.result()
+}
+
+// validateFreshness checks the snapshot age thresholds of target, or the
+// global ones for an empty target.
+func (c *Config) validateFreshness(v *validator, path []any, target BackupTarget) {
+	warn, crit, err := c.Freshness(target)
+	if err != nil {
+		v.errorf(path, "%s", err)
+		return
+	}
+	if crit < warn {
+		field := "maxAgeCritical"
+		if target.MaxAgeCritical == "" && (target.MaxAge != "" || c.MaxAgeCritical == "") {
+			field = "maxAge"
+		}
+		v.errorf(append(path, field), "maxAgeCritical %s is shorter than maxAge %s", crit, warn)
+	}
+}
+
+var jobTypes = []string{JobBackup, JobPrune, JobCheck, JobDrill}
+
+func validateRestoreOptions(v *validator, path []any, opts RestoreOptions) {
+	if opts.Verify != "" && !slices.Contains(VerifyModes, opts.Verify) {
+		v.errorf(append(path, "verify"), "unsupported verify mode %q, expected one of %s", opts.Verify, strings.Join(VerifyModes, ", "))
+	}
+	for _, table := range []struct {
+		key string
+		ids map[int]int
+	}{{"uidMap", opts.UIDMap}, {"gidMap", opts.GIDMap}} {
+		for from, to := range table.ids {
+			if from < 0 || to < 0 {
+				v.errorf(append(path, table.key), "invalid mapping %d: %d, IDs cannot be negative", from, to)
+			}
+		}
+	}
+}
+
+func (c *Config) validateRetention(v *validator, path []any, retention Retention) {
+	if retention.IsZero() {
+		v.errorf(path, "retention keeps no snapshots, set at least one keep option")
+	}
+	if retention.KeepWithin != "" && !keepWithinRe.MatchString(retention.KeepWithin) {
+		v.errorf(append(path, "keepWithin"), "invalid duration %q, expected years, months, days and hours such as 1y6m or 14d", retention.KeepWithin)
+	}
+}
+
+// webhookTemplateFuncs declares the functions notify provides to webhook
+// templates, parsing only needs their names.
+var webhookTemplateFuncs = template.FuncMap{"json": func(any) (string, error) { return "", nil }}
+
+var notifierTypes = []string{NotifierWebhook, NotifierNtfy, NotifierGotify, NotifierMatrix, NotifierSMTP}
+
+func (c *Config) validateNotifications(v *validator, n *Notifications) {
+	if n.RateLimit != "" {
+		if _, err := ParseDuration(n.RateLimit); err != nil {
+			v.errorf([]any{"notifications", "rateLimit"}, "invalid duration: %s", err)
+		}
+	}
+	names := map[string]bool{}
+	for i, notifier := range n.Notifiers {
+		path := []any{"notifications", "notifiers", i}
+		if notifier.Name == "" {
+			v.errorf(path, "name is required")
+		} else if names[notifier.Name] {
+			v.errorf(append(path, "name"), "duplicate notifier name %q", notifier.Name)
+		}
+		names[notifier.Name] = true
+		if !slices.Contains(notifierTypes, notifier.Type) {
+			v.errorf(append(path, "type"), "unsupported notifier type %q, expected one of %s", notifier.Type, strings.Join(notifierTypes, ", "))
+			continue
+		}
+		var required []string
+		switch notifier.Type {
+		case NotifierWebhook, NotifierNtfy:
+			required = []string{"url"}
+		case NotifierGotify:
+			required = []string{"url", "token"}
+		case NotifierMatrix:
+			required = []string{"url", "token", "room"}
+		case NotifierSMTP:
+			required = []string{"host", "from", "to"}
+		}
+		values := map[string]bool{
+			"url":   notifier.URL != "",
+			"token": notifier.Token != "",
+			"room":  notifier.Room != "",
+			"host":  notifier.Host != "",
+			"from":  notifier.From != "",
+			"to":    len(notifier.To) > 0,
+		}
+		for _, field := range required {
+			if !values[field] {
+				v.errorf(path, "%s is required for %s notifiers", field, notifier.Type)
+			}
+		}
+		if notifier.Template != "" {
+			if _, err := template.New("").Funcs(webhookTemplateFuncs).Parse(notifier.Template); err != nil {
+				v.errorf(append(path, "template"), "invalid template: %s", err)
+			}
+		}
+	}
+	for i, route := range n.Routes {
+		path := []any{"notifications", "routes", i}
+		if len(route.Events) == 0 {
+			v.errorf(path, "events is required")
+		}
+		for j, pattern := range route.Events {
+			if _, err := pathpkg.Match(pattern, ""); err != nil {
+				v.errorf(append(path, "events", j), "invalid pattern %q: %s", pattern, err)
+			}
+		}
+		for j, name := range route.Notifiers {
+			if !names[name] {
+				v.errorf(append(path, "notifiers", j), "notifier %q is not defined", name)
+			}
+		}
+		if route.RateLimit != "" {
+			if _, err := ParseDuration(route.RateLimit); err != nil {
+				v.errorf(append(path, "rateLimit"), "invalid duration: %s", err)
+			}
+		}
+	}
+}
+
+// keepWithinRe matches the restic duration format, where m are months.
+var keepWithinRe = regexp.MustCompile(`^([0-9]+[ymdh])+$`)
+
+// ValidateHooks checks that every hook command exists and is executable on
+// this host.
+func (c *Config) ValidateHooks() error {
+	v := &validator{cfg: c}
+	for i, target := range c.BackupTargets {
+		for _, hook := range []struct {
+			key     string
+			command []string
+		}{{"pre-restore-hook", target.PreRestoreHook}, {"post-restore-hook", target.PostRestoreHook}} {
+			if len(hook.command) == 0 || hook.command[0] == "" {
+				continue
+			}
+			if err := checkExecutable(hook.command[0]); err != nil {
+				v.errorf([]any{"backupTargets", i, hook.key, 0}, "%s", err)
+			}
+		}
+	}
+	return v.result()
+}
+
+func checkExecutable(command string) error {
+	if !strings.Contains(command, string(filepath.Separator)) {
+		if _, err := exec.LookPath(command); err != nil {
+			return fmt.Errorf("command %q not found in PATH", command)
+		}
+		return nil
+	}
+	finfo, err := os.Stat(command)
+	if err != nil {
+		return fmt.Errorf("command %q does not exist", command)
+	}
+	if finfo.IsDir() || finfo.Mode().Perm()&0o111 == 0 {
+		return fmt.Errorf("command %q is not executable", command)
+	}
+	return nil
+}
+
+// lookupNode walks the YAML document along path. It returns the deepest node
+// that could be reached, so missing keys point at their parent.
+func lookupNode(root *yaml.Node, path []any) *yaml.Node {
+	if root == nil {
+		return nil
+	}
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, elem := range path {
+		next := childNode(node, elem)
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node
+}
+
+func childNode(node *yaml.Node, elem any) *yaml.Node {
+	switch key := elem.(type) {
+	case string:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1]
+			}
+		}
+	case int:
+		if node.Kind == yaml.SequenceNode && key < len(node.Content) {
+			return node.Content[key]
+		}
+	}
+	return nil
+}
+
+func fieldName(path []any) string {
+	var b strings.Builder
+	for _, elem := range path {
+		switch key := elem.(type) {
+		case string:
+			if b.Len() > 0 {
+				b.WriteString(".")
+			}
+			b.WriteString(key)
+		case int:
+			b.WriteString("[" + strconv.Itoa(key) + "]")
+		}
+	}
+	if b.Len() == 0 {
+		return "(root)"
+	}
+	return b.String()
+}
@@ -0,0 +1,223 @@
+// Package history is the audit log of the operations zxcvmk ran.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Entry is one recorded operation.
+type Entry struct {
+	ID        uint64   `json:"id"`
+	Operation string   `json:"operation"`
+	Targets   []string `json:"targets"`
+	User      string   `json:"user"`
+	// SudoUser is the user who ran zxcvmk through sudo.
+	SudoUser string `json:"sudoUser,omitempty" output:"wide"`
+	// RemoteUser is the API user who triggered the operation through
+	// zxcvmk serve.
+	RemoteUser string        `json:"remoteUser,omitempty" output:"wide"`
+	Host       string        `json:"host" output:"wide"`
+	Args       []string      `json:"args" output:"wide"`
+	Repository string        `json:"repository,omitempty"`
+	Snapshot   string        `json:"snapshot,omitempty"`
+	Hooks      []Hook        `json:"hooks,omitempty" output:"-"`
+	Started    time.Time     `json:"started" output:"time"`
+	Duration   time.Duration `json:"duration"`
+	Success    bool          `json:"success"`
+	Error      string        `json:"error,omitempty" output:"wide"`
+}
+
+// Hook is a hook run during an operation.
+type Hook struct {
+	Name     string        `json:"name"`
+	Target   string        `json:"target"`
+	Command  []string      `json:"command"`
+	ExitCode int           `json:"exitCode"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// NewEntry starts the entry of an operation run by the current user with
+// the arguments of this process.
+func NewEntry(operation string, targets ...string) *Entry {
+	e := &Entry{
+		Operation: operation,
+		Targets:   targets,
+		Args:      os.Args,
+		Started:   time.Now(),
+		SudoUser:  os.Getenv("SUDO_USER"),
+	}
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	} else {
+		e.User = fmt.Sprint(os.Getuid())
+	}
+	e.Host, _ = os.Hostname()
+	return e
+}
+
+// Finish records the outcome of the operation.
+func (e *Entry) Finish(err error) {
+	e.Duration = time.Since(e.Started)
+	e.Success = err == nil
+	if err != nil {
+		e.Error = err.Error()
+	}
+}
+
+// AddHook records a hook that ran for target.
+func (e *Entry) AddHook(name, target string, command []string, started time.Time, exitCode int, err error) {
+	hook := Hook{
+		Name:     name,
+		Target:   target,
+		Command:  command,
+		ExitCode: exitCode,
+		Duration: time.Since(started),
+	}
+	if err != nil {
+		hook.Error = err.Error()
+	}
+	e.Hooks = append(e.Hooks, hook)
+}
+
+var entriesBucket = []byte("entries")
+
+// Store is the history database in the state directory.
+type Store struct {
+	path string
+}
+
+// Open returns the store in dir. The database is created on the first Add.
+func Open(dir string) *Store {
+	return &Store{path: filepath.Join(dir, "history.db")}
+}
+
+func (s *Store) open(readOnly bool) (*bolt.DB, error) {
+	if !readOnly {
+		if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	// the database is locked while open, other runs wait for it
+	db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open history %s: %w", s.path, err)
+	}
+	return db, nil
+}
+
+// Add stores e and assigns its ID.
+func (s *Store) Add(e *Entry) error {
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+		if e.ID, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key(e.ID), data)
+	})
+}
+
+func key(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+// Query selects entries. Zero fields match everything.
+type Query struct {
+	ID        uint64
+	Operation string
+	// Target matches entries of the path, of a path below it or of a
+	// target containing it.
+	Target string
+	User   string
+	Since  time.Time
+	Until  time.Time
+	Failed bool
+	Limit  int
+}
+
+// Query returns the matching entries, newest first.
+func (s *Store) Query(q Query) ([]*Entry, error) {
+	entries := []*Entry{}
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return entries, nil
+	}
+	db, err := s.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("history entry %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			if !q.matches(&e) {
+				continue
+			}
+			entries = append(entries, &e)
+			if q.Limit > 0 && len(entries) >= q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (q Query) matches(e *Entry) bool {
+	switch {
+	case q.ID != 0 && e.ID != q.ID:
+		return false
+	case q.Operation != "" && e.Operation != q.Operation:
+		return false
+	case q.User != "" && e.User != q.User && e.SudoUser != q.User && e.RemoteUser != q.User:
+		return false
+	case !q.Since.IsZero() && e.Started.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && e.Started.After(q.Until):
+		return false
+	case q.Failed && e.Success:
+		return false
+	}
+	if q.Target == "" {
+		return true
+	}
+	for _, target := range e.Targets {
+		if within(q.Target, target) || within(target, q.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether path is dir or below it.
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
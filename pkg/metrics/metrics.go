@@ -0,0 +1,149 @@
+// Package metrics renders gauges in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Set is a set of gauge families, written in the order they were first
+// added.
+type Set struct {
+	families map[string]*family
+	order    []string
+}
+
+type family struct {
+	help    string
+	samples []sample
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// NewSet returns an empty Set.
+func NewSet() *Set {
+	return &Set{families: map[string]*family{}}
+}
+
+// Gauge adds a sample of the gauge name. labels are name, value pairs.
+func (s *Set) Gauge(name, help string, value float64, labels ...string) {
+	f, ok := s.families[name]
+	if !ok {
+		f = &family{help: help}
+		s.families[name] = f
+		s.order = append(s.order, name)
+	}
+	f.samples = append(f.samples, sample{labels: labels, value: value})
+}
+
+// WriteTo writes the set in the text exposition format.
+func (s *Set) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	for _, name := range s.order {
+		f := s.families[name]
+		fmt.Fprintf(cw, "# HELP %s %s\n", name, escapeHelp(f.help))
+		fmt.Fprintf(cw, "# TYPE %s gauge\n", name)
+		for _, sample := range f.samples {
+			cw.WriteString(name)
+			if len(sample.labels) > 0 {
+				cw.WriteString("{")
+				for i := 0; i+1 < len(sample.labels); i += 2 {
+					if i > 0 {
+						cw.WriteString(",")
+					}
+					fmt.Fprintf(cw, "%s=\"%s\"", sample.labels[i], escapeLabel(sample.labels[i+1]))
+				}
+				cw.WriteString("}")
+			}
+			cw.WriteString(" " + formatValue(sample.value) + "\n")
+		}
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+// WriteFile writes the set to path for the node_exporter textfile collector.
+// The file is replaced atomically so the collector never reads a partial
+// file.
+func (s *Set) WriteFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := s.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Bool returns 1 for true and 0 for false.
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+func (c *countingWriter) WriteString(s string) {
+	_, _ = c.Write([]byte(s))
+}
@@ -0,0 +1,161 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"zxcvmk/pkg/secrets"
+)
+
+// Webhook posts the event to a URL, as JSON or rendered by a template.
+type Webhook struct {
+	Client   *http.Client
+	URL      string
+	Headers  map[string]string
+	template *template.Template
+}
+
+// NewWebhook returns a webhook notifier. An empty body template posts the
+// event as JSON. Templates can use the json function to quote values.
+func NewWebhook(client *http.Client, url string, headers map[string]string, body string) (*Webhook, error) {
+	w := &Webhook{Client: client, URL: url, Headers: headers}
+	if body != "" {
+		tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+			"json": func(v any) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+		}).Parse(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template: %w", err)
+		}
+		w.template = tmpl
+	}
+	return w, nil
+}
+
+func (w *Webhook) Notify(ctx context.Context, event Event) error {
+	var body bytes.Buffer
+	if w.template != nil {
+		if err := w.template.Execute(&body, event); err != nil {
+			return err
+		}
+	} else if err := json.NewEncoder(&body).Encode(event); err != nil {
+		return err
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	for k, v := range w.Headers {
+		headers[k] = v
+	}
+	return send(ctx, w.Client, http.MethodPost, w.URL, headers, &body)
+}
+
+// Ntfy publishes the event to an ntfy topic URL.
+type Ntfy struct {
+	Client   *http.Client
+	URL      string
+	Token    secrets.Secret
+	Priority int
+}
+
+func (n *Ntfy) Notify(ctx context.Context, event Event) error {
+	priority := n.Priority
+	if priority == 0 {
+		priority = map[Severity]int{SeverityInfo: 3, SeverityWarning: 4, SeverityError: 5}[event.Severity]
+	}
+	headers := map[string]string{
+		"Title":    event.Title,
+		"Priority": strconv.Itoa(priority),
+		"Tags":     map[Severity]string{SeverityInfo: "white_check_mark", SeverityWarning: "warning", SeverityError: "rotating_light"}[event.Severity],
+	}
+	if !n.Token.IsZero() {
+		headers["Authorization"] = "Bearer " + n.Token.Value()
+	}
+	return send(ctx, n.Client, http.MethodPost, n.URL, headers, strings.NewReader(event.Message))
+}
+
+// Gotify posts the event as a message of a Gotify application.
+type Gotify struct {
+	Client   *http.Client
+	URL      string
+	Token    secrets.Secret
+	Priority int
+}
+
+func (g *Gotify) Notify(ctx context.Context, event Event) error {
+	priority := g.Priority
+	if priority == 0 {
+		priority = map[Severity]int{SeverityInfo: 2, SeverityWarning: 5, SeverityError: 8}[event.Severity]
+	}
+	body, err := json.Marshal(map[string]any{
+		"title":    event.Title,
+		"message":  event.Message,
+		"priority": priority,
+	})
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{
+		"Content-Type": "application/json",
+		"X-Gotify-Key": g.Token.Value(),
+	}
+	return send(ctx, g.Client, http.MethodPost, strings.TrimSuffix(g.URL, "/")+"/message", headers, bytes.NewReader(body))
+}
+
+// Matrix sends the event as a text message to a Matrix room.
+type Matrix struct {
+	Client     *http.Client
+	Homeserver string
+	Token      secrets.Secret
+	Room       string
+}
+
+// matrixTxn makes the transaction IDs of a process unique.
+var matrixTxn atomic.Uint64
+
+func (m *Matrix) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(map[string]string{
+		"msgtype": "m.text",
+		"body":    event.Title + "\n" + event.Message,
+	})
+	if err != nil {
+		return err
+	}
+	txn := fmt.Sprintf("zxcvmk-%d-%d", time.Now().UnixNano(), matrixTxn.Add(1))
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimSuffix(m.Homeserver, "/"), url.PathEscape(m.Room), txn)
+	headers := map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": "Bearer " + m.Token.Value(),
+	}
+	return send(ctx, m.Client, http.MethodPut, endpoint, headers, bytes.NewReader(body))
+}
+
+func send(ctx context.Context, client *http.Client, method, url string, headers map[string]string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return checkResponse(resp)
+}
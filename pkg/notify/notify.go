@@ -0,0 +1,237 @@
+// Package notify sends events such as failed restores or stale snapshots to
+// notification channels.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/secrets"
+	"zxcvmk/pkg/state"
+)
+
+// Severity of an event.
+type Severity string
+
+const (
+	SeverityInfo    Severity = "info"
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Event is something worth telling a human about. Type is "<operation>.
+// <outcome>", e.g. "restore.failed", "replant.succeeded" or
+// "snapshot.stale".
+type Event struct {
+	Type     string    `json:"type"`
+	Severity Severity  `json:"severity"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+	Target   string    `json:"target,omitempty"`
+	Host     string    `json:"host"`
+	Time     time.Time `json:"time"`
+}
+
+// NewEvent returns an event of this host at the current time.
+func NewEvent(eventType string, severity Severity, target, title, message string) Event {
+	host, _ := os.Hostname()
+	return Event{
+		Type:     eventType,
+		Severity: severity,
+		Title:    title,
+		Message:  message,
+		Target:   target,
+		Host:     host,
+		Time:     time.Now(),
+	}
+}
+
+// OperationEvent returns the "<operation>.succeeded" or "<operation>.failed"
+// event of an operation on target that ended with err.
+func OperationEvent(operation, target string, duration time.Duration, err error) Event {
+	if err != nil {
+		return NewEvent(operation+".failed", SeverityError, target,
+			fmt.Sprintf("%s of %s failed", operation, target),
+			fmt.Sprintf("%s of %s failed after %s: %s", operation, target, duration.Round(time.Second), err))
+	}
+	return NewEvent(operation+".succeeded", SeverityInfo, target,
+		fmt.Sprintf("%s of %s succeeded", operation, target),
+		fmt.Sprintf("%s of %s succeeded in %s", operation, target, duration.Round(time.Second)))
+}
+
+// Notifier delivers an event to one channel.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// httpTimeout bounds each delivery, a slow notification channel must not
+// hold up a restore.
+const httpTimeout = 30 * time.Second
+
+type route struct {
+	events    []string
+	notifiers []string
+	rateLimit time.Duration
+	// rateLimitSet tells a configured rate limit, also 0, from none.
+	rateLimitSet bool
+}
+
+// defaultRateLimits apply to events repeated by every run of a periodic
+// check while nothing changes, when no rate limit is configured.
+var defaultRateLimits = map[string]time.Duration{
+	"snapshot.stale": time.Hour,
+}
+
+// Dispatcher routes events to the configured notifiers.
+type Dispatcher struct {
+	notifiers map[string]Notifier
+	// order keeps the configuration order for routes-less configurations
+	order  []string
+	routes []route
+	store  *state.Store
+}
+
+// New builds the dispatcher of the notifications configuration. It returns
+// an empty dispatcher without one.
+func New(ctx context.Context, cfg *config.Config, resolver *secrets.Resolver) (*Dispatcher, error) {
+	d := &Dispatcher{
+		notifiers: map[string]Notifier{},
+		store:     state.Open(cfg.StateDirectory()),
+	}
+	n := cfg.Notifications
+	if n == nil {
+		return d, nil
+	}
+	client := &http.Client{Timeout: httpTimeout}
+	for _, notifierConfig := range n.Notifiers {
+		notifier, err := newNotifier(ctx, notifierConfig, resolver, client)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %w", notifierConfig.Name, err)
+		}
+		d.notifiers[notifierConfig.Name] = notifier
+		d.order = append(d.order, notifierConfig.Name)
+	}
+
+	var rateLimit time.Duration
+	if n.RateLimit != "" {
+		var err error
+		if rateLimit, err = config.ParseDuration(n.RateLimit); err != nil {
+			return nil, fmt.Errorf("invalid rateLimit: %w", err)
+		}
+	}
+	routes := n.Routes
+	if len(routes) == 0 {
+		// without routes every event goes to every notifier
+		routes = []config.NotificationRoute{{Events: []string{"*"}, Notifiers: d.order}}
+	}
+	for _, r := range routes {
+		rt := route{events: r.Events, notifiers: r.Notifiers, rateLimit: rateLimit, rateLimitSet: n.RateLimit != ""}
+		if r.RateLimit != "" {
+			rt.rateLimitSet = true
+			var err error
+			if rt.rateLimit, err = config.ParseDuration(r.RateLimit); err != nil {
+				return nil, fmt.Errorf("invalid route rateLimit: %w", err)
+			}
+		}
+		d.routes = append(d.routes, rt)
+	}
+	return d, nil
+}
+
+func newNotifier(ctx context.Context, c config.Notifier, resolver *secrets.Resolver, client *http.Client) (Notifier, error) {
+	token, err := resolver.Resolve(ctx, c.Token)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Type {
+	case config.NotifierWebhook:
+		return NewWebhook(client, c.URL, c.Headers, c.Template)
+	case config.NotifierNtfy:
+		return &Ntfy{Client: client, URL: c.URL, Token: token, Priority: c.Priority}, nil
+	case config.NotifierGotify:
+		return &Gotify{Client: client, URL: c.URL, Token: token, Priority: c.Priority}, nil
+	case config.NotifierMatrix:
+		return &Matrix{Client: client, Homeserver: c.URL, Token: token, Room: c.Room}, nil
+	case config.NotifierSMTP:
+		password, err := resolver.Resolve(ctx, c.Password)
+		if err != nil {
+			return nil, err
+		}
+		return &SMTP{Host: c.Host, Port: c.Port, Username: c.Username, Password: password, From: c.From, To: c.To}, nil
+	}
+	return nil, fmt.Errorf("unsupported notifier type %q", c.Type)
+}
+
+// Emit sends event to the notifiers of every matching route, skipping the
+// ones that got the same event type for the same target within the rate
+// limit. Without a configured rate limit, snapshot.stale is limited to once
+// an hour. Delivery errors are returned joined, all notifiers are tried.
+func (d *Dispatcher) Emit(ctx context.Context, event Event) error {
+	var errs []error
+	sent := map[string]bool{}
+	for _, r := range d.routes {
+		if !matches(r.events, event.Type) {
+			continue
+		}
+		for _, name := range r.notifiers {
+			if sent[name] {
+				continue
+			}
+			sent[name] = true
+			rateLimit := r.rateLimit
+			if !r.rateLimitSet {
+				rateLimit = defaultRateLimits[event.Type]
+			}
+			key := "notify/" + name + "/" + event.Type + "/" + event.Target
+			limited := false
+			if rateLimit > 0 {
+				allowed, err := d.store.Allow(key, rateLimit, event.Time)
+				if err != nil {
+					slog.Warn("could not check notification rate limit", "error", err)
+				} else if !allowed {
+					slog.Debug("notification rate limited", "notifier", name, "event", event.Type, "target", event.Target)
+					continue
+				}
+				limited = err == nil
+			}
+			notifyCtx, cancel := context.WithTimeout(ctx, httpTimeout)
+			err := d.notifiers[name].Notify(notifyCtx, event)
+			cancel()
+			if err != nil {
+				// a failed delivery does not use up the rate limit
+				if limited {
+					if err := d.store.Release(key, event.Time); err != nil {
+						slog.Warn("could not release notification rate limit", "error", err)
+					}
+				}
+				errs = append(errs, fmt.Errorf("notifier %s: %w", name, err))
+				continue
+			}
+			slog.Debug("notification sent", "notifier", name, "event", event.Type)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func matches(patterns []string, eventType string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, eventType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkResponse turns non-2xx responses into errors.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
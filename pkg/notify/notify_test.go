@@ -0,0 +1,483 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zxcvmk/pkg/config"
+	"zxcvmk/pkg/secrets"
+)
+
+// request is an HTTP request received by a stand-in server.
+type request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+// recorder starts an HTTP stand-in answering status and recording the
+// requests it gets.
+func recorder(t *testing.T, status int) (*httptest.Server, func() []request) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, request{Method: r.Method, Path: r.URL.Path, Header: r.Header, Body: string(body)})
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []request {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]request(nil), requests...)
+	}
+}
+
+func testEvent() Event {
+	return Event{
+		Type:     "restore.failed",
+		Severity: SeverityError,
+		Title:    "restore of /srv/app failed",
+		Message:  "restore of /srv/app failed after 3s: hook failed",
+		Target:   "/srv/app",
+		Host:     "backup1",
+		Time:     time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func only(t *testing.T, requests []request) request {
+	t.Helper()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	return requests[0]
+}
+
+func TestWebhookJSON(t *testing.T) {
+	server, requests := recorder(t, http.StatusOK)
+	w, err := NewWebhook(server.Client(), server.URL+"/hook", map[string]string{"X-Api-Key": "k"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Notify(context.Background(), testEvent()); err != nil {
+		t.Fatal(err)
+	}
+	req := only(t, requests())
+	if req.Method != http.MethodPost || req.Path != "/hook" {
+		t.Errorf("got %s %s, want POST /hook", req.Method, req.Path)
+	}
+	if got := req.Header.Get("X-Api-Key"); got != "k" {
+		t.Errorf("X-Api-Key = %q, want k", got)
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(req.Body), &event); err != nil {
+		t.Fatalf("body is not an event: %v", err)
+	}
+	if event != testEvent() {
+		t.Errorf("got event %+v, want %+v", event, testEvent())
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	server, requests := recorder(t, http.StatusOK)
+	w, err := NewWebhook(server.Client(), server.URL, nil, `{"text": {{json .Title}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Notify(context.Background(), testEvent()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := only(t, requests()).Body, `{"text": "restore of /srv/app failed"}`; got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
+
+func TestWebhookErrorStatus(t *testing.T) {
+	server, _ := recorder(t, http.StatusInternalServerError)
+	w, err := NewWebhook(server.Client(), server.URL, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Notify(context.Background(), testEvent()); err == nil {
+		t.Error("a 500 response is not an error")
+	}
+}
+
+func TestNtfy(t *testing.T) {
+	server, requests := recorder(t, http.StatusOK)
+	n := &Ntfy{Client: server.Client(), URL: server.URL + "/backups", Token: secrets.New("tk")}
+	if err := n.Notify(context.Background(), testEvent()); err != nil {
+		t.Fatal(err)
+	}
+	req := only(t, requests())
+	for header, want := range map[string]string{
+		"Title":         "restore of /srv/app failed",
+		"Priority":      "5",
+		"Tags":          "rotating_light",
+		"Authorization": "Bearer tk",
+	} {
+		if got := req.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	if req.Path != "/backups" || req.Body != testEvent().Message {
+		t.Errorf("got %s with %q", req.Path, req.Body)
+	}
+}
+
+func TestGotify(t *testing.T) {
+	server, requests := recorder(t, http.StatusOK)
+	g := &Gotify{Client: server.Client(), URL: server.URL + "/", Token: secrets.New("app"), Priority: 7}
+	if err := g.Notify(context.Background(), testEvent()); err != nil {
+		t.Fatal(err)
+	}
+	req := only(t, requests())
+	if req.Path != "/message" {
+		t.Errorf("path = %s, want /message", req.Path)
+	}
+	if got := req.Header.Get("X-Gotify-Key"); got != "app" {
+		t.Errorf("X-Gotify-Key = %q, want app", got)
+	}
+	var body struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Title != testEvent().Title || body.Message != testEvent().Message || body.Priority != 7 {
+		t.Errorf("got %+v", body)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	server, requests := recorder(t, http.StatusOK)
+	m := &Matrix{Client: server.Client(), Homeserver: server.URL, Token: secrets.New("mx"), Room: "!room:example.org"}
+	for range 2 {
+		if err := m.Notify(context.Background(), testEvent()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reqs := requests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(reqs))
+	}
+	prefix := "/_matrix/client/v3/rooms/!room:example.org/send/m.room.message/"
+	for _, req := range reqs {
+		if req.Method != http.MethodPut || !strings.HasPrefix(req.Path, prefix) {
+			t.Errorf("got %s %s, want PUT %s...", req.Method, req.Path, prefix)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer mx" {
+			t.Errorf("Authorization = %q", got)
+		}
+	}
+	if reqs[0].Path == reqs[1].Path {
+		t.Error("transaction IDs are reused")
+	}
+	var body map[string]string
+	if err := json.Unmarshal([]byte(reqs[0].Body), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["msgtype"] != "m.text" || body["body"] != testEvent().Title+"\n"+testEvent().Message {
+		t.Errorf("got %v", body)
+	}
+}
+
+// smtpSession is what a stand-in SMTP server received.
+type smtpSession struct {
+	Auth string
+	From string
+	To   []string
+	Data string
+}
+
+// smtpServer accepts a single plain text SMTP session with AUTH PLAIN.
+func smtpServer(t *testing.T) (string, int, <-chan smtpSession) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		r := bufio.NewReader(conn)
+		reply := func(s string) { _, _ = io.WriteString(conn, s+"\r\n") }
+		var session smtpSession
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				_, encoded, _ := strings.Cut(arg, " ")
+				decoded, _ := base64.StdEncoding.DecodeString(encoded)
+				session.Auth = string(decoded)
+				reply("235 authenticated")
+			case "MAIL":
+				session.From = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+				reply("250 OK")
+			case "RCPT":
+				session.To = append(session.To, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				session.Data = data.String()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				sessions <- session
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	return host, portNumber, sessions
+}
+
+func TestSMTP(t *testing.T) {
+	host, port, sessions := smtpServer(t)
+	s := &SMTP{
+		Host:     host,
+		Port:     port,
+		Username: "zx",
+		Password: secrets.New("pw"),
+		From:     "zxcvmk@example.org",
+		To:       []string{"ops@example.org", "oncall@example.org"},
+	}
+	event := testEvent()
+	event.Title = "multi\r\nline"
+	if err := s.Notify(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	var session smtpSession
+	select {
+	case session = <-sessions:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no SMTP session")
+	}
+	if session.Auth != "\x00zx\x00pw" {
+		t.Errorf("auth = %q", session.Auth)
+	}
+	if session.From != s.From || strings.Join(session.To, ",") != "ops@example.org,oncall@example.org" {
+		t.Errorf("got from %s to %v", session.From, session.To)
+	}
+	for _, want := range []string{
+		"Subject: [zxcvmk] multi  line\r\n",
+		"To: ops@example.org, oncall@example.org\r\n",
+		event.Message,
+		"target: /srv/app\r\n",
+		"event: restore.failed\r\n",
+	} {
+		if !strings.Contains(session.Data, want) {
+			t.Errorf("message lacks %q:\n%s", want, session.Data)
+		}
+	}
+}
+
+// fakeNotifier records the events it gets and fails with err.
+type fakeNotifier struct {
+	mu     sync.Mutex
+	events []Event
+	err    error
+}
+
+func (f *fakeNotifier) Notify(ctx context.Context, event Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+	return f.err
+}
+
+func (f *fakeNotifier) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.events)
+}
+
+// dispatcher builds a dispatcher of the notifications with the named fake
+// notifiers in place of the configured ones.
+func dispatcher(t *testing.T, n *config.Notifications, fakes map[string]*fakeNotifier) *Dispatcher {
+	t.Helper()
+	for name := range fakes {
+		n.Notifiers = append(n.Notifiers, config.Notifier{Name: name, Type: config.NotifierWebhook, URL: "http://127.0.0.1:1"})
+	}
+	cfg := &config.Config{StateDir: t.TempDir(), Notifications: n}
+	d, err := New(context.Background(), cfg, secrets.NewResolver(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, fake := range fakes {
+		d.notifiers[name] = fake
+	}
+	return d
+}
+
+func TestEmitRoutes(t *testing.T) {
+	pager, chat := &fakeNotifier{}, &fakeNotifier{}
+	d := dispatcher(t, &config.Notifications{Routes: []config.NotificationRoute{
+		{Events: []string{"*.failed"}, Notifiers: []string{"pager", "chat"}},
+		{Events: []string{"restore.*"}, Notifiers: []string{"chat"}},
+	}}, map[string]*fakeNotifier{"pager": pager, "chat": chat})
+
+	failed := testEvent()
+	if err := d.Emit(context.Background(), failed); err != nil {
+		t.Fatal(err)
+	}
+	succeeded := testEvent()
+	succeeded.Type = "restore.succeeded"
+	if err := d.Emit(context.Background(), succeeded); err != nil {
+		t.Fatal(err)
+	}
+	stale := testEvent()
+	stale.Type = "snapshot.stale"
+	if err := d.Emit(context.Background(), stale); err != nil {
+		t.Fatal(err)
+	}
+
+	// chat matches both routes for restore.failed but gets it once
+	if got := pager.count(); got != 1 {
+		t.Errorf("pager got %d events, want 1", got)
+	}
+	if got := chat.count(); got != 2 {
+		t.Errorf("chat got %d events, want 2", got)
+	}
+}
+
+func TestEmitWithoutRoutes(t *testing.T) {
+	a, b := &fakeNotifier{}, &fakeNotifier{}
+	d := dispatcher(t, &config.Notifications{}, map[string]*fakeNotifier{"a": a, "b": b})
+	if err := d.Emit(context.Background(), testEvent()); err != nil {
+		t.Fatal(err)
+	}
+	if a.count() != 1 || b.count() != 1 {
+		t.Errorf("got %d and %d events, want every event everywhere", a.count(), b.count())
+	}
+}
+
+func TestEmitErrors(t *testing.T) {
+	broken := &fakeNotifier{err: errors.New("down")}
+	working := &fakeNotifier{}
+	d := dispatcher(t, &config.Notifications{}, map[string]*fakeNotifier{"broken": broken, "working": working})
+	err := d.Emit(context.Background(), testEvent())
+	if err == nil || !strings.Contains(err.Error(), "notifier broken: down") {
+		t.Errorf("got error %v, want the failure of broken", err)
+	}
+	if working.count() != 1 {
+		t.Error("a failing notifier stopped the others")
+	}
+}
+
+func TestEmitRateLimit(t *testing.T) {
+	limited, unlimited := &fakeNotifier{}, &fakeNotifier{}
+	d := dispatcher(t, &config.Notifications{
+		RateLimit: "1h",
+		Routes: []config.NotificationRoute{
+			{Events: []string{"*"}, Notifiers: []string{"limited"}},
+			{Events: []string{"*"}, Notifiers: []string{"unlimited"}, RateLimit: "0s"},
+		},
+	}, map[string]*fakeNotifier{"limited": limited, "unlimited": unlimited})
+
+	event := testEvent()
+	emit := func(at time.Time, target string) {
+		t.Helper()
+		e := event
+		e.Time, e.Target = at, target
+		if err := d.Emit(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	emit(event.Time, "/srv/app")
+	emit(event.Time.Add(30*time.Minute), "/srv/app")
+	// another target is limited on its own
+	emit(event.Time.Add(30*time.Minute), "/srv/db")
+	emit(event.Time.Add(61*time.Minute), "/srv/app")
+
+	if got := limited.count(); got != 3 {
+		t.Errorf("rate limited notifier got %d events, want 3", got)
+	}
+	if got := unlimited.count(); got != 4 {
+		t.Errorf("unlimited notifier got %d events, want 4", got)
+	}
+}
+
+func TestEmitStaleDefaultRateLimit(t *testing.T) {
+	chat := &fakeNotifier{}
+	d := dispatcher(t, &config.Notifications{}, map[string]*fakeNotifier{"chat": chat})
+	event := testEvent()
+	event.Type = "snapshot.stale"
+	for _, minutes := range []int{0, 5, 10, 65} {
+		e := event
+		e.Time = event.Time.Add(time.Duration(minutes) * time.Minute)
+		if err := d.Emit(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := chat.count(); got != 2 {
+		t.Errorf("got %d stale events in 65 minutes, want 2", got)
+	}
+}
+
+func TestEmitRateLimitAfterFailure(t *testing.T) {
+	ntfy := &fakeNotifier{err: errors.New("down")}
+	d := dispatcher(t, &config.Notifications{RateLimit: "1h"}, map[string]*fakeNotifier{"ntfy": ntfy})
+	event := testEvent()
+	if err := d.Emit(context.Background(), event); err == nil {
+		t.Fatal("got no error from a failing notifier")
+	}
+	ntfy.err = nil
+	for _, minutes := range []int{1, 2} {
+		e := event
+		e.Time = event.Time.Add(time.Duration(minutes) * time.Minute)
+		if err := d.Emit(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the failed attempt, the retry a minute later, the third is limited
+	if got := ntfy.count(); got != 2 {
+		t.Errorf("got %d attempts, want 2", got)
+	}
+}
@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+	"zxcvmk/pkg/secrets"
+)
+
+// SMTP mails the event. The connection is upgraded with STARTTLS when the
+// server offers it.
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password secrets.Secret
+	From     string
+	To       []string
+}
+
+func (s *SMTP) Notify(ctx context.Context, event Event) error {
+	port := s.Port
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(port))
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password.Value(), s.Host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [zxcvmk] %s\r\n", headerValue(event.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nhost: %s\r\ntarget: %s\r\nevent: %s\r\n", event.Message, event.Host, event.Target, event.Type)
+
+	// smtp.SendMail has no context, run it so that ctx can still abandon it
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(addr, auth, s.From, s.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// headerValue keeps header values on one line.
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,167 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// Formats lists the supported output formats, for flag help.
+const Formats = "json|yaml|table|wide|csv|tsv|go-template=...|go-template-file=...|jsonpath=..."
+
+// Options select how data is rendered.
+type Options struct {
+	// Format is one of Formats. Empty means DefaultFormat.
+	Format string
+	// Columns limits table, wide, csv and tsv output to the given columns.
+	Columns []string
+	// SortBy sorts rows by a column, a leading "-" sorts descending.
+	SortBy string
+	// DefaultFormat is used when Format is empty.
+	DefaultFormat string
+}
+
+// Print renders data and writes it to stdout.
+func Print(data any, opts Options) error {
+	return Write(os.Stdout, data, opts)
+}
+
+// Write renders data and writes it to w.
+func Write(w io.Writer, data any, opts Options) error {
+	out, err := Render(data, opts)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, out)
+	return err
+}
+
+// Render renders data in the requested format.
+//
+// Tables are built from structs or slices of structs. Columns are the
+// exported fields named after their json tag, an `output` tag tunes them:
+// "-" hides the field, "wide" only shows it in wide output and "time"
+// renders RFC3339 timestamps relative to now.
+func Render(data any, opts Options) (string, error) {
+	format := opts.Format
+	if format == "" {
+		format = opts.DefaultFormat
+	}
+	if format == "" {
+		format = "json"
+	}
+	name, arg, _ := strings.Cut(format, "=")
+	switch name {
+	case "json":
+		jsonData, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(jsonData) + "\n", nil
+
+	case "yaml":
+		yamlData, err := yaml.Marshal(data)
+		if err != nil {
+			return "", err
+		}
+		return string(yamlData), nil
+
+	case "table", "wide":
+		t, err := newTable(data, opts, name == "wide")
+		if err != nil {
+			return "", err
+		}
+		return t.text(), nil
+
+	case "csv", "tsv":
+		t, err := newTable(data, opts, true)
+		if err != nil {
+			return "", err
+		}
+		return t.csv(name == "tsv")
+
+	case "go-template", "go-template-file":
+		text := arg
+		if name == "go-template-file" {
+			content, err := os.ReadFile(arg)
+			if err != nil {
+				return "", err
+			}
+			text = string(content)
+		}
+		return renderTemplate(data, text)
+
+	case "jsonpath":
+		return renderJSONPath(data, arg)
+	}
+	return "", fmt.Errorf("unsupported output format %q, expected one of %s", format, Formats)
+}
+
+// generic converts data to the maps and slices encoding/json produces, so
+// that templates and jsonpath address fields by their json names.
+func generic(data any) (any, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err = json.Unmarshal(jsonData, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func renderTemplate(data any, text string) (string, error) {
+	if text == "" {
+		return "", fmt.Errorf("go-template output requires a template")
+	}
+	tmpl, err := template.New("output").Funcs(template.FuncMap{
+		"ago":  humanTime,
+		"json": func(v any) (string, error) { b, err := json.Marshal(v); return string(b), err },
+	}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template: %w", err)
+	}
+	v, err := generic(data)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, v); err != nil {
+		return "", err
+	}
+	return withNewline(buf.String()), nil
+}
+
+func renderJSONPath(data any, expr string) (string, error) {
+	if expr == "" {
+		return "", fmt.Errorf("jsonpath output requires an expression")
+	}
+	jp := jsonpath.New("output")
+	if err := jp.Parse(expr); err != nil {
+		return "", fmt.Errorf("invalid jsonpath: %w", err)
+	}
+	v, err := generic(data)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = jp.Execute(&buf, v); err != nil {
+		return "", err
+	}
+	return withNewline(buf.String()), nil
+}
+
+func withNewline(s string) string {
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		return s + "\n"
+	}
+	return s
+}
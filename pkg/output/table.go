@@ -0,0 +1,352 @@
+package output
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+type column struct {
+	name  string
+	index []int
+	wide  bool
+	time  bool
+}
+
+type table struct {
+	columns []column
+	rows    [][]reflect.Value
+	// relative renders time columns relative to now
+	relative bool
+}
+
+func newTable(data any, opts Options, wide bool) (*table, error) {
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return &table{}, nil
+		}
+		v = v.Elem()
+	}
+	var items []reflect.Value
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, indirect(v.Index(i)))
+		}
+	default:
+		items = []reflect.Value{v}
+	}
+
+	elemType := v.Type()
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		elemType = elemType.Elem()
+	}
+	for elemType.Kind() == reflect.Pointer {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("table output is not supported for %s, use json or yaml", elemType)
+	}
+
+	t := &table{relative: !wide}
+	all := structColumns(elemType)
+	if len(opts.Columns) > 0 {
+		for _, name := range opts.Columns {
+			i := slices.IndexFunc(all, func(c column) bool { return strings.EqualFold(c.name, name) })
+			if i < 0 {
+				return nil, fmt.Errorf("unknown column %q, available: %s", name, columnNames(all))
+			}
+			t.columns = append(t.columns, all[i])
+		}
+	} else {
+		for _, c := range all {
+			if wide || !c.wide {
+				t.columns = append(t.columns, c)
+			}
+		}
+	}
+
+	for _, item := range items {
+		row := make([]reflect.Value, len(t.columns))
+		for i, c := range t.columns {
+			if item.IsValid() {
+				row[i] = fieldByIndex(item, c.index)
+			}
+		}
+		t.rows = append(t.rows, row)
+	}
+	if opts.SortBy != "" {
+		if err := t.sort(all, items, opts.SortBy); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func structColumns(t reflect.Type) []column {
+	var columns []column
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("output")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && indirectType(f.Type).Kind() == reflect.Struct {
+			for _, c := range structColumns(indirectType(f.Type)) {
+				c.index = append([]int{i}, c.index...)
+				columns = append(columns, c)
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		options := strings.Split(tag, ",")
+		columns = append(columns, column{
+			name:  name,
+			index: []int{i},
+			wide:  slices.Contains(options, "wide"),
+			time:  slices.Contains(options, "time") || f.Type == reflect.TypeOf(time.Time{}),
+		})
+	}
+	return columns
+}
+
+func columnNames(columns []column) string {
+	names := make([]string, 0, len(columns))
+	for _, c := range columns {
+		names = append(names, c.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (t *table) sort(all []column, items []reflect.Value, sortBy string) error {
+	desc := strings.HasPrefix(sortBy, "-")
+	name := strings.TrimPrefix(sortBy, "-")
+	i := slices.IndexFunc(all, func(c column) bool { return strings.EqualFold(c.name, name) })
+	if i < 0 {
+		return fmt.Errorf("cannot sort by unknown column %q, available: %s", name, columnNames(all))
+	}
+	keys := make([]reflect.Value, len(items))
+	for j, item := range items {
+		if item.IsValid() {
+			keys[j] = fieldByIndex(item, all[i].index)
+		}
+	}
+	order := make([]int, len(t.rows))
+	for j := range order {
+		order[j] = j
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		c := compare(keys[a], keys[b])
+		if desc {
+			return -c
+		}
+		return c
+	})
+	rows := make([][]reflect.Value, len(t.rows))
+	for j, k := range order {
+		rows[j] = t.rows[k]
+	}
+	t.rows = rows
+	return nil
+}
+
+func compare(a, b reflect.Value) int {
+	a, b = indirect(a), indirect(b)
+	if !a.IsValid() || !b.IsValid() {
+		return boolCompare(a.IsValid(), b.IsValid())
+	}
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmpOrdered(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmpOrdered(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return cmpOrdered(a.Float(), b.Float())
+	case reflect.Bool:
+		return boolCompare(a.Bool(), b.Bool())
+	}
+	if at, ok := a.Interface().(time.Time); ok {
+		return at.Compare(b.Interface().(time.Time))
+	}
+	// RFC3339 timestamps in the same zone sort correctly as strings
+	return strings.Compare(cell(a, false, false), cell(b, false, false))
+}
+
+func cmpOrdered[T int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolCompare(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	}
+	return 1
+}
+
+func (t *table) header() []string {
+	header := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		header[i] = strings.ToUpper(c.name)
+	}
+	return header
+}
+
+func (t *table) text() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, strings.Join(t.header(), "\t"))
+	for _, row := range t.rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			cells[i] = strings.ReplaceAll(cell(v, t.columns[i].time, t.relative), "\t", " ")
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	_ = w.Flush()
+	return buf.String()
+}
+
+func (t *table) csv(tabs bool) (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if tabs {
+		w.Comma = '\t'
+	}
+	if err := w.Write(t.header()); err != nil {
+		return "", err
+	}
+	for _, row := range t.rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			cells[i] = cell(v, false, false)
+		}
+		if err := w.Write(cells); err != nil {
+			return "", err
+		}
+	}
+	w.Flush()
+	return buf.String(), w.Error()
+}
+
+// cell formats a single value. Time columns are rendered relative to now
+// when relative is set.
+func cell(v reflect.Value, isTime, relative bool) string {
+	v = indirect(v)
+	if !v.IsValid() {
+		return ""
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		if t.IsZero() {
+			return ""
+		}
+		if relative {
+			return humanTime(t)
+		}
+		return t.Format(time.RFC3339)
+	}
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	switch v.Kind() {
+	case reflect.String:
+		if isTime && relative {
+			if t, err := time.Parse(time.RFC3339Nano, v.String()); err == nil {
+				return humanTime(t)
+			}
+		}
+		return v.String()
+	case reflect.Slice, reflect.Array:
+		parts := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			parts = append(parts, cell(v.Index(i), isTime, relative))
+		}
+		return strings.Join(parts, ",")
+	case reflect.Map, reflect.Struct:
+		b, err := json.Marshal(v.Interface())
+		if err != nil {
+			return fmt.Sprint(v.Interface())
+		}
+		return string(b)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// humanTime renders t relative to now, e.g. "3h ago". It accepts time.Time
+// and RFC3339 strings, so templates can use it on generic data.
+func humanTime(v any) string {
+	var t time.Time
+	switch value := v.(type) {
+	case time.Time:
+		t = value
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return value
+		}
+		t = parsed
+	default:
+		return fmt.Sprint(v)
+	}
+	d := time.Since(t)
+	if d < 0 {
+		return "in " + duration.HumanDuration(-d)
+	}
+	return duration.HumanDuration(d) + " ago"
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex without panicking on nil
+// embedded pointers.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for _, i := range index {
+		v = indirect(v)
+		if !v.IsValid() {
+			return reflect.Value{}
+		}
+		v = v.Field(i)
+	}
+	return v
+}
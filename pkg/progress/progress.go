@@ -0,0 +1,155 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Event describes the state of a long running transfer at a point in time.
+type Event struct {
+	Source     string
+	Path       string
+	Percent    float64
+	BytesDone  uint64
+	BytesTotal uint64
+	FilesDone  uint64
+	FilesTotal uint64
+	ETA        time.Duration
+}
+
+// Func receives progress events. A nil Func is valid and ignores all events.
+type Func func(Event)
+
+// Report calls f with e if f is set.
+func (f Func) Report(e Event) {
+	if f != nil {
+		f(e)
+	}
+}
+
+// Reporter emits progress events as slog records and, when attached to a
+// terminal, as a single line progress bar.
+type Reporter struct {
+	out         io.Writer
+	tty         bool
+	logInterval time.Duration
+
+	mu       sync.Mutex
+	lastLog  map[string]time.Time
+	drawn    bool
+	barWidth int
+}
+
+// NewReporter creates a Reporter drawing to out. The bar is only drawn when
+// out is a terminal.
+func NewReporter(out *os.File) *Reporter {
+	return &Reporter{
+		out:         out,
+		tty:         term.IsTerminal(int(out.Fd())),
+		logInterval: 10 * time.Second,
+		lastLog:     map[string]time.Time{},
+		barWidth:    30,
+	}
+}
+
+// Report handles a single progress event.
+func (r *Reporter) Report(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := e.Source + ":" + e.Path
+	if last, ok := r.lastLog[key]; !ok || time.Since(last) >= r.logInterval || e.Percent >= 100 {
+		r.lastLog[key] = time.Now()
+		// the bar shares the line with the log output, so clear it first
+		r.clear()
+		slog.Info("progress",
+			"source", e.Source,
+			"path", e.Path,
+			"percent", fmt.Sprintf("%.1f", e.Percent),
+			"bytes_done", e.BytesDone,
+			"bytes_total", e.BytesTotal,
+			"files_done", e.FilesDone,
+			"files_total", e.FilesTotal,
+			"eta", e.ETA.Round(time.Second).String(),
+		)
+	}
+	if r.tty {
+		r.draw(e)
+	}
+}
+
+// Func returns the reporter as a Func.
+func (r *Reporter) Func() Func {
+	return r.Report
+}
+
+// Done finishes the current progress bar line.
+func (r *Reporter) Done() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tty && r.drawn {
+		fmt.Fprintln(r.out)
+		r.drawn = false
+	}
+}
+
+func (r *Reporter) clear() {
+	if r.tty && r.drawn {
+		fmt.Fprint(r.out, "\r\033[K")
+		r.drawn = false
+	}
+}
+
+func (r *Reporter) draw(e Event) {
+	percent := e.Percent
+	if percent > 100 {
+		percent = 100
+	}
+	filled := int(percent / 100 * float64(r.barWidth))
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", r.barWidth-filled)
+	line := "\r\033[K" + e.Source
+	// concurrent transfers take turns on the line, the path tells them apart
+	if e.Path != "" {
+		line += " " + e.Path
+	}
+	line += fmt.Sprintf(" [%s] %5.1f%% %s/%s", bar, percent, FormatBytes(e.BytesDone), FormatBytes(e.BytesTotal))
+	if e.FilesTotal > 0 {
+		line += fmt.Sprintf(" %d/%d files", e.FilesDone, e.FilesTotal)
+	}
+	if e.ETA > 0 {
+		line += " ETA " + e.ETA.Round(time.Second).String()
+	}
+	fmt.Fprint(r.out, line)
+	r.drawn = true
+}
+
+// FormatBytes formats a byte count using binary units.
+func FormatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// EstimateETA derives the remaining time from the elapsed time and the
+// completed fraction.
+func EstimateETA(elapsed time.Duration, percent float64) time.Duration {
+	if percent <= 0 || percent >= 100 {
+		return 0
+	}
+	total := float64(elapsed) * 100 / percent
+	return time.Duration(total - float64(elapsed))
+}
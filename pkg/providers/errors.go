@@ -0,0 +1,101 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Error classes returned by providers and the restore flow. Use errors.Is to
+// tell them apart, the concrete errors carry the details.
+var (
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrRepoNotFound     = errors.New("repository not found")
+	ErrRepoLocked       = errors.New("repository is locked")
+	ErrAuth             = errors.New("authentication failed")
+	ErrHookFailed       = errors.New("hook failed")
+	ErrTargetMissing    = errors.New("target missing")
+	ErrInterrupted      = errors.New("interrupted")
+	ErrVerifyFailed     = errors.New("restored files differ from the snapshot")
+)
+
+// CommandError is returned when an external backup tool fails.
+type CommandError struct {
+	Command  string
+	ExitCode int
+	Stderr   string
+	// Kind is one of the error classes above, or nil if the failure could
+	// not be classified.
+	Kind error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("%s failed with exit code %d", e.Command, e.ExitCode)
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	if e.Stderr != "" {
+		msg += ": " + strings.TrimSpace(e.Stderr)
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Kind
+}
+
+// resticExitCodes maps the documented restic exit codes onto error classes.
+var resticExitCodes = map[int]error{
+	10:  ErrRepoNotFound,
+	11:  ErrRepoLocked,
+	12:  ErrAuth,
+	130: ErrInterrupted,
+}
+
+// resticStderrPatterns classifies failures of restic versions that predate
+// the dedicated exit codes.
+var resticStderrPatterns = []struct {
+	pattern string
+	kind    error
+}{
+	{"repository is already locked", ErrRepoLocked},
+	{"unable to create lock", ErrRepoLocked},
+	{"wrong password", ErrAuth},
+	{"no key found", ErrAuth},
+	{"Is there a repository at the following location", ErrRepoNotFound},
+	{"repository does not exist", ErrRepoNotFound},
+	{"no matching ID found", ErrSnapshotNotFound},
+	{"no snapshot found", ErrSnapshotNotFound},
+}
+
+// resticError converts the error of a finished restic command into a
+// CommandError.
+func resticError(ctx context.Context, command string, err error, stderr string) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return fmt.Errorf("restic %s: %w", command, err)
+	}
+	if stderr == "" {
+		stderr = string(exitErr.Stderr)
+	}
+	cmdErr := &CommandError{
+		Command:  "restic " + command,
+		ExitCode: exitErr.ExitCode(),
+		Stderr:   stderr,
+		Kind:     resticExitCodes[exitErr.ExitCode()],
+	}
+	if cmdErr.Kind == nil {
+		for _, p := range resticStderrPatterns {
+			if strings.Contains(stderr, p.pattern) {
+				cmdErr.Kind = p.kind
+				break
+			}
+		}
+	}
+	if cmdErr.Kind == nil && ctx.Err() != nil {
+		cmdErr.Kind = ErrInterrupted
+	}
+	return cmdErr
+}
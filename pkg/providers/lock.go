@@ -0,0 +1,150 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Lock describes a lock held on a backup repository.
+type Lock struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Exclusive bool      `json:"exclusive"`
+	Hostname  string    `json:"hostname"`
+	Username  string    `json:"username"`
+	PID       int       `json:"pid"`
+	UID       int       `json:"uid"`
+	GID       int       `json:"gid"`
+}
+
+// Age returns how long the lock has been held.
+func (l *Lock) Age() time.Duration {
+	return time.Since(l.Time)
+}
+
+// Stale reports whether the lock is older than maxAge or belongs to a
+// process on this host that no longer exists.
+func (l *Lock) Stale(maxAge time.Duration) bool {
+	if maxAge > 0 && l.Age() > maxAge {
+		return true
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname != l.Hostname {
+		return false
+	}
+	return !processAlive(l.PID)
+}
+
+func (l *Lock) String() string {
+	return fmt.Sprintf("lock %s held by PID %d on %s by %s, created %s ago", shortID(l.ID), l.PID, l.Hostname, l.Username, l.Age().Round(time.Second))
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// Locker is implemented by providers whose repositories can be locked.
+type Locker interface {
+	ListLocks(ctx context.Context) ([]*Lock, error)
+	RemoveLocks(ctx context.Context, locks []*Lock) error
+}
+
+// ListLocks returns the locks currently held on the repository.
+func (r ResticProvider) ListLocks(ctx context.Context) ([]*Lock, error) {
+	output, err := r.command(ctx, "list", "locks", "--no-lock").Output()
+	if err != nil {
+		return nil, resticError(ctx, "list locks", err, "")
+	}
+	var locks []*Lock
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		id := strings.TrimSpace(scanner.Text())
+		if id == "" {
+			continue
+		}
+		out, err := r.command(ctx, "cat", "lock", id, "--no-lock").Output()
+		if err != nil {
+			// the lock may have been released in the meantime
+			if ctx.Err() != nil {
+				return nil, resticError(ctx, "cat lock", err, "")
+			}
+			continue
+		}
+		lock := &Lock{ID: id}
+		if err = json.Unmarshal(out, lock); err != nil {
+			return nil, fmt.Errorf("error unmarshalling lock %s: %w", id, err)
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+// RemoveLocks removes the given locks. Lock files of local repositories are
+// deleted one by one. Remote repositories are unlocked with plain restic
+// unlock, which only removes the locks restic itself considers stale, so
+// live locks of other runs are left alone.
+func (r ResticProvider) RemoveLocks(ctx context.Context, locks []*Lock) error {
+	if len(locks) == 0 {
+		return nil
+	}
+	if repo, ok := r.localRepositoryPath(); ok {
+		for _, lock := range locks {
+			err := os.Remove(filepath.Join(repo, "locks", lock.ID))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("cannot remove %s: %w", lock, err)
+			}
+		}
+		return nil
+	}
+
+	if _, err := r.command(ctx, "unlock").Output(); err != nil {
+		return resticError(ctx, "unlock", err, "")
+	}
+	current, err := r.ListLocks(ctx)
+	if err != nil {
+		return err
+	}
+	var kept int
+	for _, lock := range current {
+		if slices.ContainsFunc(locks, func(l *Lock) bool { return l.ID == lock.ID }) {
+			kept++
+		}
+	}
+	if kept > 0 {
+		return fmt.Errorf("%w: restic does not consider %d of the locks stale yet", ErrRepoLocked, kept)
+	}
+	return nil
+}
+
+// localRepositoryPath returns the directory of the repository if it is a
+// plain directory, as opposed to one of the restic backends addressed as
+// "<backend>:<location>".
+func (r ResticProvider) localRepositoryPath() (string, bool) {
+	repo := strings.TrimPrefix(r.BackupRepository, "local:")
+	if strings.Contains(repo, ":") && !filepath.IsAbs(repo) {
+		return "", false
+	}
+	finfo, err := os.Stat(filepath.Join(repo, "locks"))
+	return repo, err == nil && finfo.IsDir()
+}
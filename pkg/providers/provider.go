@@ -1,20 +1,197 @@
 package providers
 
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"zxcvmk/pkg/progress"
+)
+
 // type BackupProvider defines the methods that a backup provider must implement.
 type BackupProvider interface {
-	ListSnapshots(filterPaths []string) ([]*Snapshot, error)
-	MountSnapshot(snapshotID string, mountPath string) error
-	RestoreSnapshot(snapshotID string, target string, paths []string) error
+	ListSnapshots(ctx context.Context, filterPaths []string) ([]*Snapshot, error)
+	MountSnapshot(ctx context.Context, snapshotID string, mountPath string) error
+	RestoreSnapshot(ctx context.Context, snapshotID string, target string, paths []string, onProgress progress.Func) error
+}
+
+// InPlaceRestorer is implemented by providers that can restore paths
+// directly over the live files, without a staging directory.
+type InPlaceRestorer interface {
+	RestoreInPlace(ctx context.Context, snapshotID string, paths []string, opts InPlaceOptions, onProgress progress.Func) error
+}
+
+// InPlaceOptions configures an in-place restore.
+type InPlaceOptions struct {
+	// Overwrite selects which existing files are replaced: "always",
+	// "if-changed", "if-newer" or "never".
+	Overwrite string
+	// Delete removes the files below the paths that are not in the
+	// snapshot.
+	Delete bool
+}
+
+// OverwriteModes are the valid InPlaceOptions.Overwrite values.
+var OverwriteModes = []string{"always", "if-changed", "if-newer", "never"}
+
+// Copier is implemented by providers that can natively copy snapshots from
+// another repository. CopySnapshots returns errors.ErrUnsupported if it
+// cannot copy from the given provider.
+type Copier interface {
+	CopySnapshots(ctx context.Context, from BackupProvider, snapshotIDs []string) error
+}
+
+// Backuper is implemented by providers that can create snapshots.
+type Backuper interface {
+	Backup(ctx context.Context, paths []string, opts BackupOptions) error
 }
 
+// BackupOptions tune a single backup run.
+type BackupOptions struct {
+	// Dir is the working directory relative paths are resolved against.
+	Dir string
+	// Host overrides the hostname recorded in the snapshot.
+	Host string
+	// Time overrides the snapshot time.
+	Time time.Time
+	Tags []string
+}
+
+// Snapshot is a single snapshot in a repository. The output tags select the
+// table columns, see output.Render.
 type Snapshot struct {
-	Time     string   `json:"time"`
-	Tree     string   `json:"tree"`
+	Time     string   `json:"time" output:"time"`
+	Tree     string   `json:"tree" output:"wide"`
 	Paths    []string `json:"paths"`
+	Tags     []string `json:"tags,omitempty"`
 	Hostname string   `json:"hostname"`
-	Username string   `json:"username"`
-	UID      int      `json:"uid"`
-	GID      int      `json:"gid"`
-	ID       string   `json:"id"`
+	Username string   `json:"username" output:"wide"`
+	UID      int      `json:"uid" output:"wide"`
+	GID      int      `json:"gid" output:"wide"`
+	ID       string   `json:"id" output:"wide"`
 	ShortID  string   `json:"short_id"`
+	// Summary is recorded by restic 0.17 and later.
+	Summary *SnapshotSummary `json:"summary,omitempty" output:"-"`
+	// Size is the restore size in bytes, 0 if unknown.
+	Size ByteSize `json:"size,omitempty"`
+	// Repository is the name of the configured repository holding the
+	// snapshot. It is filled in by the caller, not the provider.
+	Repository string `json:"repository,omitempty"`
+}
+
+// ByteSize is a size in bytes, printed in binary units. Zero means unknown
+// and prints as an empty string.
+type ByteSize uint64
+
+func (b ByteSize) String() string {
+	if b == 0 {
+		return ""
+	}
+	return progress.FormatBytes(uint64(b))
+}
+
+// SnapshotSummary holds the statistics of the backup run that created a
+// snapshot.
+type SnapshotSummary struct {
+	BackupStart         string `json:"backup_start"`
+	BackupEnd           string `json:"backup_end"`
+	FilesNew            uint64 `json:"files_new"`
+	FilesChanged        uint64 `json:"files_changed"`
+	FilesUnmodified     uint64 `json:"files_unmodified"`
+	DataAdded           uint64 `json:"data_added"`
+	DataAddedPacked     uint64 `json:"data_added_packed"`
+	TotalFilesProcessed uint64 `json:"total_files_processed"`
+	TotalBytesProcessed uint64 `json:"total_bytes_processed"`
+}
+
+// SizeReporter is implemented by providers that can compute the restore size
+// of snapshots lacking a summary. This is usually expensive.
+type SizeReporter interface {
+	SnapshotSize(ctx context.Context, snapshotID string) (uint64, error)
+}
+
+// RepositorySizer is implemented by providers that can report the space a
+// repository, or the data referenced by some of its snapshots, takes in its
+// storage. Data shared by the snapshots is counted once.
+type RepositorySizer interface {
+	RepositorySize(ctx context.Context, snapshotIDs ...string) (uint64, error)
+}
+
+// Checker is implemented by providers that can verify the integrity of a
+// repository.
+type Checker interface {
+	Check(ctx context.Context, opts CheckOptions) error
+}
+
+// CheckOptions configures a repository check.
+type CheckOptions struct {
+	// ReadData is the part of the pack files to read and verify, e.g.
+	// "5%" or "1/7". Empty only checks the repository structure.
+	ReadData string
+}
+
+// Pruner is implemented by providers that can remove snapshots according to
+// a retention policy.
+type Pruner interface {
+	Prune(ctx context.Context, opts PruneOptions) error
+}
+
+// PruneOptions is a retention policy, as the restic forget --keep-* options.
+type PruneOptions struct {
+	KeepLast    int
+	KeepHourly  int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	KeepWithin  string
+	// Paths limits pruning to the snapshots of these paths.
+	Paths []string
+	// DryRun only reports the snapshots that would be removed.
+	DryRun bool
+}
+
+// Browser is implemented by providers that can list and read the files of a
+// snapshot without restoring it.
+type Browser interface {
+	// ListFiles returns path and, if it is a directory, its immediate
+	// children.
+	ListFiles(ctx context.Context, snapshotID string, path string) ([]*File, error)
+	// Dump writes the contents of a file, or a tar archive of a directory,
+	// to w.
+	Dump(ctx context.Context, snapshotID string, path string, w io.Writer) error
+}
+
+// Walker is implemented by providers that can list everything below a path
+// of a snapshot.
+type Walker interface {
+	// WalkFiles calls fn for path and every file and directory below it.
+	WalkFiles(ctx context.Context, snapshotID string, path string, fn func(*File) error) error
+}
+
+// File is a file or directory in a snapshot.
+type File struct {
+	Name    string      `json:"name"`
+	Path    string      `json:"path" output:"wide"`
+	Type    string      `json:"type"`
+	Size    ByteSize    `json:"size,omitempty"`
+	Mode    os.FileMode `json:"mode"`
+	UID     int         `json:"uid" output:"wide"`
+	GID     int         `json:"gid" output:"wide"`
+	ModTime time.Time   `json:"mtime" output:"time"`
+}
+
+// IsDir reports whether f is a directory.
+func (f *File) IsDir() bool {
+	return f.Type == "dir"
+}
+
+// Timestamp parses the snapshot time.
+func (s *Snapshot) Timestamp() (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s.Time)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q of snapshot %s: %w", s.Time, s.ShortID, err)
+	}
+	return t, nil
 }
@@ -1,60 +1,246 @@
 package providers
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"zxcvmk/pkg/progress"
+	"zxcvmk/pkg/secrets"
 )
 
 type ResticProvider struct {
-	BackupRepositoryPasswordLocation string
-	BackupRepository                 string
+	Password         secrets.Secret
+	BackupRepository string
+	// RetryLock makes restic wait up to the given duration for a locked
+	// repository instead of failing right away.
+	RetryLock time.Duration
 }
 
 // NewResticProvider creates a new instance of ResticProvider.
-func NewResticProvider(passwordLocation, repository string) *ResticProvider {
+func NewResticProvider(password secrets.Secret, repository string) *ResticProvider {
 	return &ResticProvider{
-		BackupRepositoryPasswordLocation: passwordLocation,
-		BackupRepository:                 repository,
+		Password:         password,
+		BackupRepository: repository,
 	}
 }
 
+// command prepares a restic invocation against the configured repository.
+// When ctx is cancelled restic receives SIGINT, giving it the chance to
+// remove its lock before exiting. The password is passed in the environment,
+// never on the command line.
+func (r ResticProvider) command(ctx context.Context, args ...string) *exec.Cmd {
+	args = append(args, "-r", r.BackupRepository)
+	if r.RetryLock > 0 && !slices.Contains(args, "--no-lock") {
+		args = append(args, "--retry-lock", r.RetryLock.String())
+	}
+	cmd := exec.CommandContext(ctx, "restic", args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = 30 * time.Second
+	if !r.Password.IsZero() {
+		// restic prefers an inherited password file or command over
+		// RESTIC_PASSWORD
+		env := slices.DeleteFunc(os.Environ(), func(v string) bool {
+			name, _, _ := strings.Cut(v, "=")
+			return slices.Contains(passwordVariables, name)
+		})
+		cmd.Env = append(env, "RESTIC_PASSWORD="+r.Password.Value())
+	}
+	return cmd
+}
+
+// passwordVariables are the environment variables restic reads the
+// repository password from.
+var passwordVariables = []string{"RESTIC_PASSWORD", "RESTIC_PASSWORD_FILE", "RESTIC_PASSWORD_COMMAND"}
+
 // ListSnapshots returns a list of available snapshots from the restic repository.
-func (r ResticProvider) ListSnapshots(filterPaths []string) ([]*Snapshot, error) {
-	command := []string{"restic", "snapshots", "--json"}
-	command = append(command, "-r", r.BackupRepository)
+func (r ResticProvider) ListSnapshots(ctx context.Context, filterPaths []string) ([]*Snapshot, error) {
+	command := []string{"snapshots", "--json"}
 	if len(filterPaths) > 0 {
 		for _, path := range filterPaths {
 			command = append(command, "--path", path)
 		}
 	}
-	cmd := exec.Command(command[0], command[1:]...)
-	if r.BackupRepositoryPasswordLocation != "" {
-		cmd.Env = append(os.Environ(), fmt.Sprintf("RESTIC_PASSWORD_FILE=%s", r.BackupRepositoryPasswordLocation))
-	}
+	cmd := r.command(ctx, command...)
 
 	output, err := cmd.Output()
 
 	if err != nil {
-		return nil, fmt.Errorf("error executing command: %w", err)
+		return nil, resticError(ctx, "snapshots", err, "")
 	}
 
 	var snapshots []*Snapshot
 	if err = json.Unmarshal(output, &snapshots); err != nil {
 		return nil, fmt.Errorf("error unmarshalling JSON: %w", err)
 	}
+	for _, snapshot := range snapshots {
+		if snapshot.Summary != nil {
+			snapshot.Size = ByteSize(snapshot.Summary.TotalBytesProcessed)
+		}
+	}
 
 	return snapshots, nil
 }
 
+// SnapshotSize returns the restore size of a snapshot using `restic stats`.
+func (r ResticProvider) SnapshotSize(ctx context.Context, snapshotID string) (uint64, error) {
+	output, err := r.command(ctx, "stats", "--json", "--mode", "restore-size", snapshotID).Output()
+	if err != nil {
+		return 0, resticError(ctx, "stats", err, "")
+	}
+	var stats struct {
+		TotalSize uint64 `json:"total_size"`
+	}
+	if err = json.Unmarshal(output, &stats); err != nil {
+		return 0, fmt.Errorf("error unmarshalling JSON: %w", err)
+	}
+	return stats.TotalSize, nil
+}
+
+// RepositorySize returns the size of the repository data using `restic stats
+// --mode raw-data`, limited to the data of snapshotIDs if any are given.
+func (r ResticProvider) RepositorySize(ctx context.Context, snapshotIDs ...string) (uint64, error) {
+	args := append([]string{"stats", "--json", "--mode", "raw-data"}, snapshotIDs...)
+	output, err := r.command(ctx, args...).Output()
+	if err != nil {
+		return 0, resticError(ctx, "stats", err, "")
+	}
+	var stats struct {
+		TotalSize uint64 `json:"total_size"`
+	}
+	if err = json.Unmarshal(output, &stats); err != nil {
+		return 0, fmt.Errorf("error unmarshalling JSON: %w", err)
+	}
+	return stats.TotalSize, nil
+}
+
+// Check verifies the repository with `restic check`.
+func (r ResticProvider) Check(ctx context.Context, opts CheckOptions) error {
+	args := []string{"check"}
+	if opts.ReadData != "" {
+		args = append(args, "--read-data-subset", opts.ReadData)
+	}
+	cmd := r.command(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if _, err := cmd.Output(); err != nil {
+		return resticError(ctx, "check", err, stderr.String())
+	}
+	return nil
+}
+
+// Prune removes the snapshots outside of the retention policy with `restic
+// forget --prune`. Snapshots are grouped by host and paths.
+func (r ResticProvider) Prune(ctx context.Context, opts PruneOptions) error {
+	args := []string{"forget", "--prune", "--group-by", "host,paths"}
+	for _, keep := range []struct {
+		flag  string
+		value int
+	}{
+		{"--keep-last", opts.KeepLast},
+		{"--keep-hourly", opts.KeepHourly},
+		{"--keep-daily", opts.KeepDaily},
+		{"--keep-weekly", opts.KeepWeekly},
+		{"--keep-monthly", opts.KeepMonthly},
+		{"--keep-yearly", opts.KeepYearly},
+	} {
+		if keep.value > 0 {
+			args = append(args, keep.flag, strconv.Itoa(keep.value))
+		}
+	}
+	if opts.KeepWithin != "" {
+		args = append(args, "--keep-within", opts.KeepWithin)
+	}
+	for _, path := range opts.Paths {
+		args = append(args, "--path", path)
+	}
+	if opts.DryRun {
+		args = append(args, "--dry-run")
+	}
+	cmd := r.command(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if opts.DryRun {
+		slog.Info("restic forget dry run", "output", string(output))
+	} else {
+		slog.Debug("restic forget output", "output", string(output))
+	}
+	if err != nil {
+		return resticError(ctx, "forget", err, stderr.String())
+	}
+	return nil
+}
+
+// CopySnapshots copies snapshots from another restic repository with
+// `restic copy`, which keeps the snapshot time, paths and tree.
+func (r ResticProvider) CopySnapshots(ctx context.Context, from BackupProvider, snapshotIDs []string) error {
+	src, ok := from.(*ResticProvider)
+	if !ok {
+		return fmt.Errorf("restic cannot copy from %T: %w", from, errors.ErrUnsupported)
+	}
+	if len(snapshotIDs) == 0 {
+		return nil
+	}
+	args := append([]string{"copy", "--from-repo", src.BackupRepository}, snapshotIDs...)
+	cmd := r.command(ctx, args...)
+	if !src.Password.IsZero() {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, "RESTIC_FROM_PASSWORD="+src.Password.Value())
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	slog.Debug("restic copy output", "output", string(output))
+	if err != nil {
+		return resticError(ctx, "copy", err, stderr.String())
+	}
+	return nil
+}
+
+// Backup creates a new snapshot of the given paths.
+func (r ResticProvider) Backup(ctx context.Context, paths []string, opts BackupOptions) error {
+	args := []string{"backup", "--json"}
+	if opts.Host != "" {
+		args = append(args, "--host", opts.Host)
+	}
+	if !opts.Time.IsZero() {
+		args = append(args, "--time", opts.Time.Local().Format("2006-01-02 15:04:05"))
+	}
+	for _, tag := range opts.Tags {
+		args = append(args, "--tag", tag)
+	}
+	args = append(args, paths...)
+	cmd := r.command(ctx, args...)
+	cmd.Dir = opts.Dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if _, err := cmd.Output(); err != nil {
+		return resticError(ctx, "backup", err, stderr.String())
+	}
+	return nil
+}
+
 // RestoreSnapshot restores a specific snapshot to the given location.
-func (r ResticProvider) RestoreSnapshot(snapshotID string, target string, paths []string) error {
+func (r ResticProvider) RestoreSnapshot(ctx context.Context, snapshotID string, target string, paths []string, onProgress progress.Func) error {
 	if snapshotID == "" {
 		return errors.New("snapshotID cannot be empty")
 	}
-	args := []string{"restore", snapshotID, "-r", r.BackupRepository}
+	args := []string{"restore", snapshotID, "--json"}
 	if len(paths) > 0 {
 		for _, path := range paths {
 			args = append(args, "--path", path)
@@ -64,25 +250,204 @@ func (r ResticProvider) RestoreSnapshot(snapshotID string, target string, paths
 	args = append(args, "--target", target)
 	finfo, err := os.Stat(target)
 	if os.IsNotExist(err) {
-		return fmt.Errorf("restic restore failed as the target %s does not exist", target)
+		return fmt.Errorf("%w: restic restore failed as the target %s does not exist", ErrTargetMissing, target)
+	}
+	if err != nil {
+		return fmt.Errorf("restic restore failed: %w", err)
 	}
 	if !finfo.IsDir() {
-		return fmt.Errorf("restic restore failed as the target %s is not a directory", target)
+		return fmt.Errorf("%w: restic restore failed as the target %s is not a directory", ErrTargetMissing, target)
+	}
+	return r.restore(ctx, snapshotID, args, onProgress)
+}
+
+// RestoreInPlace restores the paths of a snapshot over the live files with
+// `restic restore --target /`. It needs restic 0.17 or later.
+func (r ResticProvider) RestoreInPlace(ctx context.Context, snapshotID string, paths []string, opts InPlaceOptions, onProgress progress.Func) error {
+	if snapshotID == "" {
+		return errors.New("snapshotID cannot be empty")
+	}
+	if len(paths) == 0 {
+		return errors.New("an in-place restore needs at least one path")
+	}
+	args := []string{"restore", snapshotID, "--json", "--target", "/"}
+	for _, path := range paths {
+		args = append(args, "--include", path)
+	}
+	if opts.Overwrite != "" {
+		args = append(args, "--overwrite", opts.Overwrite)
 	}
-	cmd := exec.Command("restic", args...)
-	if r.BackupRepositoryPasswordLocation != "" {
-		cmd.Env = append(os.Environ(), fmt.Sprintf("RESTIC_PASSWORD_FILE=%s", r.BackupRepositoryPasswordLocation))
+	if opts.Delete {
+		args = append(args, "--delete")
 	}
+	return r.restore(ctx, snapshotID, args, onProgress)
+}
+
+func (r ResticProvider) restore(ctx context.Context, snapshotID string, args []string, onProgress progress.Func) error {
+	cmd := r.command(ctx, args...)
 
-	combined_output, err := cmd.CombinedOutput()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("restic restore failed: %w", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("restic restore failed: %w", err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		r.handleRestoreMessage(scanner.Bytes(), snapshotID, onProgress)
+	}
+	if err = scanner.Err(); err != nil {
+		// keep restic from blocking on a full pipe, only the progress is lost
+		slog.Warn("cannot read restic restore output", "snapshotID", snapshotID, "error", err)
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+	if err = cmd.Wait(); err != nil {
+		return resticError(ctx, "restore", err, stderr.String())
+	}
+	return nil
+}
+
+// ListFiles lists path and its immediate children with `restic ls`.
+func (r ResticProvider) ListFiles(ctx context.Context, snapshotID string, path string) ([]*File, error) {
+	var files []*File
+	err := r.ls(ctx, snapshotID, path, false, func(file *File) error {
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// WalkFiles lists path and everything below it with `restic ls --recursive`.
+func (r ResticProvider) WalkFiles(ctx context.Context, snapshotID string, path string, fn func(*File) error) error {
+	return r.ls(ctx, snapshotID, path, true, fn)
+}
+
+func (r ResticProvider) ls(ctx context.Context, snapshotID string, path string, recursive bool, fn func(*File) error) error {
+	if snapshotID == "" {
+		return errors.New("snapshotID cannot be empty")
+	}
+	args := []string{"ls", "--json"}
+	if recursive {
+		args = append(args, "--recursive")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := r.command(ctx, append(args, snapshotID, path)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("restic ls failed: %w", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("restic ls failed: %w", err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var node struct {
+			File
+			StructType  string `json:"struct_type"`
+			MessageType string `json:"message_type"`
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &node); err != nil {
+			err = fmt.Errorf("error unmarshalling JSON: %w", err)
+			break
+		}
+		// the first line describes the snapshot, newer restic versions
+		// replace struct_type with message_type
+		if node.StructType == "node" || node.MessageType == "node" {
+			file := node.File
+			if err = fn(&file); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
 	if err != nil {
-		return fmt.Errorf("restore restore failed: %s", string(combined_output))
+		// stop restic, nobody reads its output anymore
+		cancel()
+		_ = cmd.Wait()
+		return err
+	}
+	if err = cmd.Wait(); err != nil {
+		return resticError(ctx, "ls", err, stderr.String())
+	}
+	return nil
+}
+
+// Dump writes a file, or a tar archive of a directory, with `restic dump`.
+func (r ResticProvider) Dump(ctx context.Context, snapshotID string, path string, w io.Writer) error {
+	if snapshotID == "" {
+		return errors.New("snapshotID cannot be empty")
+	}
+	cmd := r.command(ctx, "dump", "--archive", "tar", snapshotID, path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdout = w
+	if err := cmd.Run(); err != nil {
+		return resticError(ctx, "dump", err, stderr.String())
+	}
+	return nil
+}
+
+// resticRestoreMessage is a line of the `restic restore --json` output. Both
+// the status and summary messages share these fields.
+type resticRestoreMessage struct {
+	MessageType      string  `json:"message_type"`
+	SecondsElapsed   float64 `json:"seconds_elapsed"`
+	SecondsRemaining float64 `json:"seconds_remaining"`
+	PercentDone      float64 `json:"percent_done"`
+	TotalFiles       uint64  `json:"total_files"`
+	FilesRestored    uint64  `json:"files_restored"`
+	TotalBytes       uint64  `json:"total_bytes"`
+	BytesRestored    uint64  `json:"bytes_restored"`
+}
+
+func (r ResticProvider) handleRestoreMessage(line []byte, snapshotID string, onProgress progress.Func) {
+	var msg resticRestoreMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		slog.Debug("restic output", "line", string(line))
+		return
+	}
+	switch msg.MessageType {
+	case "status":
+		percent := msg.PercentDone * 100
+		eta := time.Duration(msg.SecondsRemaining * float64(time.Second))
+		if eta == 0 {
+			eta = progress.EstimateETA(time.Duration(msg.SecondsElapsed*float64(time.Second)), percent)
+		}
+		onProgress.Report(progress.Event{
+			Source:     "restic",
+			Path:       snapshotID,
+			Percent:    percent,
+			BytesDone:  msg.BytesRestored,
+			BytesTotal: msg.TotalBytes,
+			FilesDone:  msg.FilesRestored,
+			FilesTotal: msg.TotalFiles,
+			ETA:        eta,
+		})
+	case "summary":
+		onProgress.Report(progress.Event{
+			Source:     "restic",
+			Path:       snapshotID,
+			Percent:    100,
+			BytesDone:  msg.BytesRestored,
+			BytesTotal: msg.TotalBytes,
+			FilesDone:  msg.FilesRestored,
+			FilesTotal: msg.TotalFiles,
+		})
 	}
-	return err
 }
 
 // MountSnapshot
-func (r ResticProvider) MountSnapshot(snapshotID string, mountPath string) error {
+func (r ResticProvider) MountSnapshot(ctx context.Context, snapshotID string, mountPath string) error {
 	// TODO: implement
 
 	return nil
@@ -0,0 +1,245 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const redacted = "[redacted]"
+
+// Secret holds a resolved secret. Its value is only available through Value,
+// formatting, marshalling and logging it yield a placeholder.
+type Secret struct {
+	value string
+}
+
+// New wraps value in a Secret.
+func New(value string) Secret {
+	return Secret{value: value}
+}
+
+// Value returns the secret value.
+func (s Secret) Value() string {
+	return s.value
+}
+
+// IsZero reports whether the secret is empty.
+func (s Secret) IsZero() bool {
+	return s.value == ""
+}
+
+func (s Secret) String() string {
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return redacted
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redacted + `"`), nil
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return redacted, nil
+}
+
+// Resolver resolves secret references and caches the result, so every
+// reference is resolved at most once per run.
+//
+// Supported references:
+//
+//	file:/path/to/file       first line of the file
+//	env:NAME                 value of the environment variable NAME
+//	cmd:pass show restic/nas first line of the command output
+//	sops:/path/file.yaml#key value decrypted with sops, optionally a single key
+//	creds:name               systemd credential from $CREDENTIALS_DIRECTORY
+//
+// A reference without a scheme is treated as a file path. The command of a
+// cmd: reference is split into words with the quoting rules of a shell, but
+// nothing is expanded.
+type Resolver struct {
+	// AgeKeyFile is handed to sops as SOPS_AGE_KEY_FILE.
+	AgeKeyFile string
+
+	mu    sync.Mutex
+	cache map[string]Secret
+}
+
+// NewResolver creates a Resolver.
+func NewResolver(ageKeyFile string) *Resolver {
+	return &Resolver{
+		AgeKeyFile: ageKeyFile,
+		cache:      map[string]Secret{},
+	}
+}
+
+// Resolve returns the secret referenced by ref. An empty ref resolves to an
+// empty secret.
+func (r *Resolver) Resolve(ctx context.Context, ref string) (Secret, error) {
+	if ref == "" {
+		return Secret{}, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if secret, ok := r.cache[ref]; ok {
+		return secret, nil
+	}
+	scheme, rest, found := strings.Cut(ref, ":")
+	if !found || filepath.IsAbs(ref) {
+		scheme, rest = "file", ref
+	}
+	var value string
+	var err error
+	switch scheme {
+	case "file":
+		value, err = readFile(rest)
+	case "env":
+		var ok bool
+		value, ok = os.LookupEnv(rest)
+		if !ok {
+			err = fmt.Errorf("environment variable %s is not set", rest)
+		}
+	case "cmd":
+		var args []string
+		if args, err = splitWords(rest); err == nil {
+			value, err = r.runCommand(ctx, args, nil)
+		}
+	case "sops":
+		value, err = r.sops(ctx, rest)
+	case "creds", "systemd-creds":
+		value, err = readCredential(rest)
+	default:
+		err = fmt.Errorf("unknown secret source %q", scheme)
+	}
+	if err != nil {
+		// the reference itself is not secret, the value never made it here
+		return Secret{}, fmt.Errorf("cannot resolve secret %s: %w", ref, err)
+	}
+	secret := New(value)
+	r.cache[ref] = secret
+	return secret, nil
+}
+
+func readFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return firstLine(data), nil
+}
+
+func readCredential(name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", errors.New("CREDENTIALS_DIRECTORY is not set, is the unit using LoadCredential=?")
+	}
+	return readFile(filepath.Join(dir, name))
+}
+
+func (r *Resolver) sops(ctx context.Context, ref string) (string, error) {
+	path, key, _ := strings.Cut(ref, "#")
+	args := []string{"sops", "--decrypt"}
+	if key != "" {
+		args = append(args, "--extract", fmt.Sprintf("[%q]", key))
+	}
+	args = append(args, path)
+	var env []string
+	if r.AgeKeyFile != "" {
+		env = []string{"SOPS_AGE_KEY_FILE=" + r.AgeKeyFile}
+	}
+	return r.runCommand(ctx, args, env)
+}
+
+func (r *Resolver) runCommand(ctx context.Context, args []string, env []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return firstLine(output), nil
+}
+
+// splitWords splits a command line into words following the shell's quoting
+// rules: single quotes, double quotes and backslashes. Nothing is expanded.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			if quote == '"' && c != '"' && c != '\\' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case unicode.IsSpace(c):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape in command")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// firstLine returns the first line of data without surrounding whitespace,
+// as restic reads password files.
+func firstLine(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if scanner.Scan() {
+		return strings.TrimSpace(scanner.Text())
+	}
+	return ""
+}
@@ -0,0 +1,148 @@
+// Package state keeps the outcome of the last run of each operation, so that
+// exporters and schedulers can report on runs of other processes.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Run is the outcome of one operation on one target.
+type Run struct {
+	// Operation is e.g. "restore", "replant" or "check".
+	Operation string `json:"operation"`
+	// Target is the restored path, the repository checked, ...
+	Target   string        `json:"target"`
+	Started  time.Time     `json:"started" output:"time"`
+	Duration time.Duration `json:"duration"`
+	Success  bool          `json:"success"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// NewRun returns the Run of an operation started at started that ended with
+// err.
+func NewRun(operation, target string, started time.Time, err error) Run {
+	run := Run{
+		Operation: operation,
+		Target:    target,
+		Started:   started,
+		Duration:  time.Since(started),
+		Success:   err == nil,
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	return run
+}
+
+// Store is the file holding the last runs, shared between processes.
+type Store struct {
+	dir string
+}
+
+// Open returns the store in dir. The directory is created on the first
+// Record.
+func Open(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// runsFile holds the last runs.
+const runsFile = "last-runs.json"
+
+// Runs returns the last run of every operation and target.
+func (s *Store) Runs() ([]Run, error) {
+	runs, err := readFile[[]Run](s, runsFile)
+	if runs == nil {
+		runs = []Run{}
+	}
+	return runs, err
+}
+
+// Record replaces the last run of run.Operation on run.Target.
+func (s *Store) Record(run Run) error {
+	return updateFile(s, runsFile, func(runs []Run) []Run {
+		for i := range runs {
+			if runs[i].Operation == run.Operation && runs[i].Target == run.Target {
+				runs[i] = run
+				return runs
+			}
+		}
+		runs = append(runs, run)
+		sort.Slice(runs, func(i, j int) bool {
+			if runs[i].Operation != runs[j].Operation {
+				return runs[i].Operation < runs[j].Operation
+			}
+			return runs[i].Target < runs[j].Target
+		})
+		return runs
+	})
+}
+
+func readFile[T any](s *Store, name string) (T, error) {
+	var v T
+	path := filepath.Join(s.dir, name)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return v, err
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("%s: %w", path, err)
+	}
+	return v, nil
+}
+
+// updateFile rewrites a file of the store under an exclusive lock,
+// concurrent runs of zxcvmk would otherwise drop each other's records.
+func updateFile[T any](s *Store, name string, fn func(T) T) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, name)
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("could not lock %s: %w", lock.Name(), err)
+	}
+
+	v, err := readFile[T](s, name)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(fn(v), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile replaces path atomically.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
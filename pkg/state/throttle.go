@@ -0,0 +1,41 @@
+package state
+
+import "time"
+
+// throttleFile holds when each throttled action last happened.
+const throttleFile = "throttle.json"
+
+// Allow reports whether the action identified by key may happen at now,
+// allowing it at most once per window, and records it if so.
+func (s *Store) Allow(key string, window time.Duration, now time.Time) (bool, error) {
+	allowed := true
+	err := updateFile(s, throttleFile, func(last map[string]time.Time) map[string]time.Time {
+		if last == nil {
+			last = map[string]time.Time{}
+		}
+		if t, ok := last[key]; ok && now.Sub(t) < window {
+			allowed = false
+			return last
+		}
+		last[key] = now
+		// forget actions that are no longer throttled by any window
+		for k, t := range last {
+			if now.Sub(t) > 30*24*time.Hour {
+				delete(last, k)
+			}
+		}
+		return last
+	})
+	return allowed, err
+}
+
+// Release takes back the action Allow recorded for key at now, e.g. because
+// it failed, so that it is allowed again right away.
+func (s *Store) Release(key string, now time.Time) error {
+	return updateFile(s, throttleFile, func(last map[string]time.Time) map[string]time.Time {
+		if t, ok := last[key]; ok && t.Equal(now) {
+			delete(last, key)
+		}
+		return last
+	})
+}